@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	AggregateMean             = "mean"
+	AggregateTimeWeightedMean = "time_weighted_mean"
+	AggregateMin              = "min"
+	AggregateMax              = "max"
+	AggregateLast             = "last"
+	AggregateCount            = "count"
+)
+
+// Aggregate summarizes the values of a sensor over consecutive time windows.
+type Aggregate struct {
+	Source   string        `json:"source" yaml:"source"`
+	Window   time.Duration `json:"window" yaml:"window"`
+	Function string        `json:"function" yaml:"function"`
+}
+
+// aggregator collects the samples of the current window.
+//
+// Windows are aligned to multiples of their duration and closed by the
+// first sample of a later window. The result is therefore available in
+// live operation as well as when replaying captures from a file.
+type aggregator struct {
+	*Aggregate
+
+	start time.Time // Begin of the current window
+
+	count    int
+	sum      float64
+	min, max float64
+
+	last     float64   // Last sample, also carried over into the next window
+	lastTime time.Time // Time up to which the area has been accumulated
+	area     float64   // Time-weighted sum of the samples
+	covered  time.Duration
+}
+
+func newAggregator(cfg *Aggregate) *aggregator {
+	return &aggregator{
+		Aggregate: cfg,
+	}
+}
+
+func (a *aggregator) Inputs() ([]string, []uint16) {
+	return []string{a.Source}, nil
+}
+
+func (a *aggregator) Evaluate(env Env, ts time.Time) (float64, error) {
+	v, ok := env.Value(a.Source)
+	if !ok {
+		return 0, ErrUnknownValue
+	}
+
+	var (
+		result float64
+		err    error = ErrUnknownValue
+	)
+
+	ws := ts.Truncate(a.Window)
+
+	if a.start.IsZero() {
+		a.start = ws
+	} else if ws.After(a.start) {
+		if a.count > 0 {
+			a.accumulate(a.start.Add(a.Window))
+			result, err = a.result(), nil
+		}
+
+		a.reset(ws)
+	}
+
+	a.accumulate(ts)
+	a.add(v, ts)
+
+	return result, err
+}
+
+// accumulate extends the time-weighted area with the last sample up to ts.
+func (a *aggregator) accumulate(ts time.Time) {
+	if a.lastTime.IsZero() || !ts.After(a.lastTime) {
+		return
+	}
+
+	dt := ts.Sub(a.lastTime)
+
+	a.area += a.last * dt.Seconds()
+	a.covered += dt
+	a.lastTime = ts
+}
+
+func (a *aggregator) add(v float64, ts time.Time) {
+	if a.count == 0 {
+		a.min, a.max = v, v
+	} else {
+		a.min = math.Min(a.min, v)
+		a.max = math.Max(a.max, v)
+	}
+
+	a.count++
+	a.sum += v
+	a.last = v
+
+	if ts.After(a.lastTime) {
+		a.lastTime = ts
+	}
+}
+
+func (a *aggregator) reset(start time.Time) {
+	a.start = start
+	a.count = 0
+	a.sum = 0
+	a.area = 0
+	a.covered = 0
+
+	// The last sample of the previous window holds until the first sample of the new one
+	if !a.lastTime.IsZero() {
+		a.lastTime = start
+	}
+}
+
+func (a *aggregator) result() float64 {
+	switch a.Function {
+	case AggregateTimeWeightedMean:
+		if a.covered > 0 {
+			return a.area / a.covered.Seconds()
+		}
+		return a.last
+
+	case AggregateMin:
+		return a.min
+
+	case AggregateMax:
+		return a.max
+
+	case AggregateLast:
+		return a.last
+
+	case AggregateCount:
+		return float64(a.count)
+	}
+
+	return a.sum / float64(a.count)
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	none := math.NaN()
+
+	// Windows start at 12:00, 12:01, 12:02, ...
+	samples := []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{10 * time.Second, 10},
+		{40 * time.Second, 20},
+		{75 * time.Second, 30}, // Closes the first window
+		{120 * time.Second, 0}, // Closes the second window exactly at its end
+		{310 * time.Second, 5}, // Closes the third window, the windows in between are empty
+		{330 * time.Second, 100},
+		{360 * time.Second, 50}, // Closes the sixth window
+	}
+
+	// Results of the windows closed by the samples, NaN if none has been closed
+	tests := []struct {
+		function string
+		want     []float64
+	}{
+		{AggregateMean, []float64{none, none, 15, 30, 0, none, 52.5}},
+		{AggregateMin, []float64{none, none, 10, 30, 0, none, 5}},
+		{AggregateMax, []float64{none, none, 20, 30, 0, none, 100}},
+		{AggregateLast, []float64{none, none, 20, 30, 0, none, 100}},
+		{AggregateCount, []float64{none, none, 2, 1, 1, none, 2}},
+
+		// The first window is only covered from its first sample at 12:00:10.
+		// Later windows start with the last sample of the previous one.
+		{AggregateTimeWeightedMean, []float64{
+			none,
+			none,
+			(10*30 + 20*20) / 50.0,
+			(20*15 + 30*45) / 60.0,
+			0,
+			none,
+			(0*10 + 5*20 + 100*30) / 60.0, // The sample of 12:02 holds until 12:05:10
+		}},
+	}
+
+	ts := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		t.Run(tt.function, func(t *testing.T) {
+			a := newAggregator(&Aggregate{
+				Source:   "power",
+				Window:   time.Minute,
+				Function: tt.function,
+			})
+
+			for i, s := range samples {
+				env := testEnv{
+					values: map[string]float64{"power": s.value},
+				}
+
+				got, err := a.Evaluate(env, ts.Add(s.offset))
+
+				if math.IsNaN(tt.want[i]) {
+					if err == nil {
+						t.Errorf("step %d: unexpected result %v", i, got)
+					}
+				} else if err != nil {
+					t.Errorf("step %d: %s", i, err)
+				} else if math.Abs(got-tt.want[i]) > 1e-9 {
+					t.Errorf("step %d: got %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorUnknownSource(t *testing.T) {
+	a := newAggregator(&Aggregate{
+		Source:   "power",
+		Window:   time.Minute,
+		Function: AggregateMean,
+	})
+
+	if _, err := a.Evaluate(testEnv{}, time.Now()); err != ErrUnknownValue {
+		t.Errorf("got %v, want %v", err, ErrUnknownValue)
+	}
+}
@@ -0,0 +1,292 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RoleReadOnly = "read-only"
+	RoleAdmin    = "admin"
+
+	// Prefixes of hashed passwords and tokens in the authentication file
+	secretPrefixSHA256 = "sha256:"
+	secretPrefixBcrypt = "$2"
+)
+
+// roleLevels orders the roles by their privileges.
+var roleLevels = map[string]int{
+	RoleReadOnly: 1,
+	RoleAdmin:    2,
+}
+
+// AuthUser is a user which authenticates with HTTP basic auth.
+type AuthUser struct {
+	Password string `yaml:"password"`
+	Role     string `yaml:"role,omitempty"`
+}
+
+// AuthToken is a bearer token.
+type AuthToken struct {
+	Name  string `yaml:"name,omitempty"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role,omitempty"`
+}
+
+// Auth holds the credentials which are accepted by the HTTP server.
+//
+// Passwords and tokens are given as bcrypt hash ("$2a$...", "$2b$..." or "$2y$...").
+// Hex encoded SHA-256 hashes with the prefix "sha256:" are only suited for randomly generated tokens
+// as they are unsalted. Plain text secrets are still accepted, but discouraged.
+type Auth struct {
+	Users  map[string]*AuthUser `yaml:"users,omitempty"`
+	Tokens []*AuthToken         `yaml:"tokens,omitempty"`
+}
+
+func ReadAuth(fn string) (*Auth, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &Auth{}
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(a); err != nil {
+		return nil, err
+	}
+
+	if len(a.Users) == 0 && len(a.Tokens) == 0 {
+		return nil, errors.New("no users or tokens defined")
+	}
+
+	for name, u := range a.Users {
+		if u == nil || u.Password == "" {
+			return nil, fmt.Errorf("user %s has no password", name)
+		}
+
+		if err := validateSecret(u.Password); err != nil {
+			return nil, fmt.Errorf("invalid password of user %s: %w", name, err)
+		}
+
+		switch secretKind(u.Password) {
+		case secretPrefixSHA256:
+			slog.Warn("Password of user is an unsalted SHA-256 hash, use bcrypt instead", slog.String("user", name))
+		case "":
+			slog.Warn("Password of user is given in plain text, use bcrypt instead", slog.String("user", name))
+		}
+
+		if err := validateRole(&u.Role); err != nil {
+			return nil, fmt.Errorf("invalid role of user %s: %w", name, err)
+		}
+	}
+
+	for i, t := range a.Tokens {
+		if t == nil || t.Token == "" {
+			return nil, fmt.Errorf("token %d is empty", i)
+		}
+
+		if err := validateSecret(t.Token); err != nil {
+			return nil, fmt.Errorf("invalid token %d: %w", i, err)
+		}
+
+		if secretKind(t.Token) == "" {
+			slog.Warn("Token is given in plain text, use a hash instead", slog.Int("index", i), slog.String("name", t.Name))
+		}
+
+		if err := validateRole(&t.Role); err != nil {
+			return nil, fmt.Errorf("invalid role of token %d: %w", i, err)
+		}
+	}
+
+	return a, nil
+}
+
+func validateRole(role *string) error {
+	if *role == "" {
+		*role = RoleReadOnly
+	}
+
+	if _, ok := roleLevels[*role]; !ok {
+		return fmt.Errorf("unknown role: %s", *role)
+	}
+
+	return nil
+}
+
+// secretKind returns the prefix of a hashed secret or an empty string for plain text secrets.
+func secretKind(s string) string {
+	switch {
+	case strings.HasPrefix(s, secretPrefixSHA256):
+		return secretPrefixSHA256
+	case strings.HasPrefix(s, secretPrefixBcrypt):
+		return secretPrefixBcrypt
+	default:
+		return ""
+	}
+}
+
+// validateSecret checks that a hashed secret is well-formed.
+func validateSecret(s string) error {
+	switch secretKind(s) {
+	case secretPrefixSHA256:
+		if h, err := hex.DecodeString(s[len(secretPrefixSHA256):]); err != nil || len(h) != sha256.Size {
+			return errors.New("malformed SHA-256 hash")
+		}
+
+	case secretPrefixBcrypt:
+		if _, err := bcrypt.Cost([]byte(s)); err != nil {
+			return fmt.Errorf("malformed bcrypt hash: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// matchSecret compares a secret of a request with a configured one in constant time.
+func matchSecret(configured, given string) bool {
+	if secretKind(configured) == secretPrefixBcrypt {
+		return bcrypt.CompareHashAndPassword([]byte(configured), []byte(given)) == nil
+	}
+
+	if h, ok := strings.CutPrefix(configured, secretPrefixSHA256); ok {
+		want, err := hex.DecodeString(h)
+		if err != nil {
+			return false
+		}
+
+		got := sha256.Sum256([]byte(given))
+
+		return subtle.ConstantTimeCompare(want, got[:]) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(configured), []byte(given)) == 1
+}
+
+// Authenticate returns the role of a request.
+// The returned bool is false if the request carried no or invalid credentials.
+func (a *Auth) Authenticate(req *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range a.Tokens {
+			if matchSecret(t.Token, token) {
+				return t.Role, true
+			}
+		}
+
+		return "", false
+	}
+
+	if username, password, ok := req.BasicAuth(); ok {
+		if u, ok := a.Users[username]; ok && matchSecret(u.Password, password) {
+			return u.Role, true
+		}
+	}
+
+	return "", false
+}
+
+// httpRequire wraps a handler so that it is only served to clients with at least the given role.
+// All clients are granted access if no authentication is configured.
+func httpRequire(auth *Auth, role string, h http.Handler) http.Handler {
+	if auth == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		granted, ok := auth.Authenticate(req)
+		if !ok {
+			slog.Debug("Rejected unauthenticated HTTP request", slog.String("remote", req.RemoteAddr), slog.String("path", req.URL.Path))
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="modbus-sniffer", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if roleLevels[granted] < roleLevels[role] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// ParseAllowList parses a comma-separated list of IP addresses and networks in CIDR notation.
+func ParseAllowList(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", e)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", e)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// httpAllow wraps a handler so that only clients from the given networks are served.
+// Forwarding headers of proxies are not trusted.
+func httpAllow(nets []*net.IPNet, h http.Handler) http.Handler {
+	if len(nets) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					h.ServeHTTP(w, req)
+					return
+				}
+			}
+		}
+
+		slog.Debug("Rejected HTTP request from address which is not allowed", slog.String("remote", req.RemoteAddr))
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
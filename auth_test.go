@@ -0,0 +1,287 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func sha256Secret(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return secretPrefixSHA256 + hex.EncodeToString(h[:])
+}
+
+func bcryptSecret(t *testing.T, s string) string {
+	t.Helper()
+
+	h, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(h)
+}
+
+func testAuth(t *testing.T) *Auth {
+	t.Helper()
+
+	return &Auth{
+		Users: map[string]*AuthUser{
+			"admin":  {Password: bcryptSecret(t, "admin-pass"), Role: RoleAdmin},
+			"viewer": {Password: sha256Secret("viewer-pass"), Role: RoleReadOnly},
+			"legacy": {Password: "plain-pass", Role: RoleReadOnly},
+		},
+		Tokens: []*AuthToken{
+			{Name: "prometheus", Token: sha256Secret("read-token"), Role: RoleReadOnly},
+			{Name: "automation", Token: bcryptSecret(t, "admin-token"), Role: RoleAdmin},
+		},
+	}
+}
+
+func TestReadAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"bcrypt", "users:\n  admin:\n    password: " + bcryptSecret(t, "secret") + "\n    role: admin\n", true},
+		{"sha256 token", "tokens:\n- token: " + sha256Secret("secret") + "\n", true},
+		{"plain text", "users:\n  viewer:\n    password: secret\n", true},
+		{"empty", "users: {}\n", false},
+		{"no password", "users:\n  viewer:\n    role: read-only\n", false},
+		{"empty token", "tokens:\n- name: prometheus\n", false},
+		{"unknown role", "users:\n  viewer:\n    password: secret\n    role: root\n", false},
+		{"unknown field", "users:\n  viewer:\n    password: secret\n    group: admin\n", false},
+		{"malformed sha256", "tokens:\n- token: sha256:0123abc\n", false},
+		{"malformed bcrypt", "users:\n  admin:\n    password: $2y$12$REPLACE-WITH-BCRYPT-HASH\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "http-auth.yaml")
+			if err := os.WriteFile(fn, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := ReadAuth(fn)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("ReadAuth() error = %v, want ok = %v", err, tt.ok)
+			}
+
+			if tt.ok {
+				for name, u := range a.Users {
+					if u.Role == "" {
+						t.Errorf("user %s has no default role", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadAuthExample(t *testing.T) {
+	if _, err := ReadAuth("etc/http-auth.yaml"); err == nil {
+		t.Error("example file with placeholders was accepted")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := testAuth(t)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		token    string
+		role     string
+		ok       bool
+	}{
+		{"bcrypt password", "admin", "admin-pass", "", RoleAdmin, true},
+		{"sha256 password", "viewer", "viewer-pass", "", RoleReadOnly, true},
+		{"plain text password", "legacy", "plain-pass", "", RoleReadOnly, true},
+		{"wrong bcrypt password", "admin", "viewer-pass", "", "", false},
+		{"wrong sha256 password", "viewer", "admin-pass", "", "", false},
+		{"wrong plain text password", "legacy", "plain-pas", "", "", false},
+		{"hash as password", "viewer", sha256Secret("viewer-pass"), "", "", false},
+		{"empty password", "admin", "", "", "", false},
+		{"unknown user", "root", "admin-pass", "", "", false},
+		{"sha256 token", "", "", "read-token", RoleReadOnly, true},
+		{"bcrypt token", "", "", "admin-token", RoleAdmin, true},
+		{"wrong token", "", "", "admin-pass", "", false},
+		{"password as token", "", "", "viewer-pass", "", false},
+		{"no credentials", "", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/sensors", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			role, ok := a.Authenticate(req)
+			if ok != tt.ok || role != tt.role {
+				t.Errorf("Authenticate() = %q, %v, want %q, %v", role, ok, tt.role, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHTTPRequire(t *testing.T) {
+	a := testAuth(t)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name  string
+		auth  *Auth
+		role  string
+		user  string
+		pass  string
+		token string
+		want  int
+	}{
+		{"no auth configured", nil, RoleAdmin, "", "", "", http.StatusOK},
+		{"unauthenticated", a, RoleReadOnly, "", "", "", http.StatusUnauthorized},
+		{"wrong password", a, RoleReadOnly, "viewer", "wrong", "", http.StatusUnauthorized},
+		{"wrong token", a, RoleReadOnly, "", "", "wrong", http.StatusUnauthorized},
+		{"read-only on read-only", a, RoleReadOnly, "viewer", "viewer-pass", "", http.StatusOK},
+		{"read-only on admin", a, RoleAdmin, "viewer", "viewer-pass", "", http.StatusForbidden},
+		{"read-only token on admin", a, RoleAdmin, "", "", "read-token", http.StatusForbidden},
+		{"admin on read-only", a, RoleReadOnly, "admin", "admin-pass", "", http.StatusOK},
+		{"admin on admin", a, RoleAdmin, "admin", "admin-pass", "", http.StatusOK},
+		{"admin token on admin", a, RoleAdmin, "", "", "admin-token", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/sensors", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rec := httptest.NewRecorder()
+			httpRequire(tt.auth, tt.role, ok).ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+
+			if challenge := rec.Header().Get("WWW-Authenticate"); (challenge != "") != (tt.want == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q for status %d", challenge, rec.Code)
+			}
+		})
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"", []string{}, true},
+		{"127.0.0.1", []string{"127.0.0.1/32"}, true},
+		{" 127.0.0.1 , 192.168.178.0/24,", []string{"127.0.0.1/32", "192.168.178.0/24"}, true},
+		{"192.168.178.10/24", []string{"192.168.178.0/24"}, true},
+		{"::1,fd00::/8", []string{"::1/128", "fd00::/8"}, true},
+		{"::ffff:10.0.0.1", []string{"10.0.0.1/32"}, true},
+		{"localhost", nil, false},
+		{"256.0.0.1", nil, false},
+		{"10.0.0.0/33", nil, false},
+		{"fd00::/129", nil, false},
+		{"10.0.0.0/", nil, false},
+		{"127.0.0.1,example.com", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			nets, err := ParseAllowList(tt.list)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("ParseAllowList() error = %v, want ok = %v", err, tt.ok)
+			}
+
+			if len(nets) != len(tt.want) {
+				t.Fatalf("ParseAllowList() = %v, want %v", nets, tt.want)
+			}
+
+			for i, n := range nets {
+				if n.String() != tt.want[i] {
+					t.Errorf("network %d = %s, want %s", i, n, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPAllow(t *testing.T) {
+	nets, err := ParseAllowList("127.0.0.1,192.168.178.0/24,::1,fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		remote string
+		want   int
+	}{
+		{"127.0.0.1:1234", http.StatusOK},
+		{"127.0.0.2:1234", http.StatusForbidden},
+		{"192.168.178.42:1234", http.StatusOK},
+		{"192.168.179.42:1234", http.StatusForbidden},
+		{"[::ffff:192.168.178.42]:1234", http.StatusOK},
+		{"[::1]:1234", http.StatusOK},
+		{"[::2]:1234", http.StatusForbidden},
+		{"[fd12:3456::1]:1234", http.StatusOK},
+		{"[fe80::1]:1234", http.StatusForbidden},
+		{"192.168.178.42", http.StatusOK},
+		{"invalid", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+
+			rec := httptest.NewRecorder()
+			httpAllow(nets, ok).ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	t.Run("empty list", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+
+		rec := httptest.NewRecorder()
+		httpAllow(nil, ok).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// availabilityTopic returns the topic on which this instance publishes the availability of its sensors.
+// It includes the client ID as multiple instances share the same node ID.
+func availabilityTopic() string {
+	return fmt.Sprintf("%s/%s/%s/availability", hassioMQTTDiscoveryPrefix, hassioMQTTNodeID, mqttOpts.ClientID)
+}
+
+// Watchdog tracks whether we are still receiving valid frames.
+// Sensors are unavailable if all tracees have been detached or no valid frame arrived within the timeout.
+type Watchdog struct {
+	client  *MQTTClient
+	timeout time.Duration
+
+	lastFrame time.Time
+	attached  int
+	available bool
+}
+
+func NewWatchdog(client *MQTTClient, timeout time.Duration, attached int) *Watchdog {
+	return &Watchdog{
+		client:    client,
+		timeout:   timeout,
+		lastFrame: time.Now(),
+		attached:  attached,
+		available: attached > 0,
+	}
+}
+
+// Frame is called for every valid frame.
+func (w *Watchdog) Frame() {
+	w.lastFrame = time.Now()
+	w.update()
+}
+
+// Detached is called when a tracee has been detached.
+func (w *Watchdog) Detached(pid int) {
+	w.attached--
+
+	slog.Warn("Tracee detached", slog.Int("pid", pid), slog.Int("remaining", w.attached))
+	stream.Event("detached", "Tracee detached", "", "pid", pid, "remaining", w.attached)
+	metrics.Tracee(pid, false)
+
+	w.update()
+}
+
+// Check is called periodically to detect timeouts.
+func (w *Watchdog) Check() {
+	w.update()
+}
+
+func (w *Watchdog) Available() bool {
+	if w.attached <= 0 {
+		return false
+	}
+
+	return w.timeout <= 0 || time.Since(w.lastFrame) < w.timeout
+}
+
+func (w *Watchdog) update() {
+	available := w.Available()
+
+	if available != w.available {
+		w.available = available
+
+		if available {
+			stream.Event("availability", "Sensors are available", "", "available", true)
+		} else {
+			stream.Event("availability", "Sensors are unavailable", "", "available", false)
+		}
+	}
+
+	metrics.SetAvailable(available)
+
+	if w.client != nil {
+		w.client.SetAvailable(available)
+	}
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+// https://www.home-assistant.io/integrations/sensor/#device-class
+var sensorDeviceClasses = map[string]bool{
+	"apparent_power":                   true,
+	"aqi":                              true,
+	"atmospheric_pressure":             true,
+	DeviceClassBattery:                 true,
+	"carbon_dioxide":                   true,
+	"carbon_monoxide":                  true,
+	DeviceClassCurrent:                 true,
+	"data_rate":                        true,
+	"data_size":                        true,
+	"date":                             true,
+	"distance":                         true,
+	"duration":                         true,
+	DeviceClassEnergy:                  true,
+	"energy_storage":                   true,
+	DeviceClassEnum:                    true,
+	DeviceClassFrequency:               true,
+	"gas":                              true,
+	"humidity":                         true,
+	"illuminance":                      true,
+	"irradiance":                       true,
+	"moisture":                         true,
+	"monetary":                         true,
+	"nitrogen_dioxide":                 true,
+	"nitrogen_monoxide":                true,
+	"nitrous_oxide":                    true,
+	"ozone":                            true,
+	"ph":                               true,
+	"pm1":                              true,
+	"pm10":                             true,
+	"pm25":                             true,
+	DeviceClassPowerFactor:             true,
+	DeviceClassPower:                   true,
+	"precipitation":                    true,
+	"precipitation_intensity":          true,
+	"pressure":                         true,
+	"reactive_power":                   true,
+	"signal_strength":                  true,
+	"sound_pressure":                   true,
+	"speed":                            true,
+	"sulphur_dioxide":                  true,
+	DeviceClassTemperature:             true,
+	"timestamp":                        true,
+	"volatile_organic_compounds":       true,
+	"volatile_organic_compounds_parts": true,
+	DeviceClassVoltage:                 true,
+	"volume":                           true,
+	"volume_storage":                   true,
+	"water":                            true,
+	"weight":                           true,
+	"wind_speed":                       true,
+}
+
+// https://www.home-assistant.io/integrations/binary_sensor/#device-class
+var binarySensorDeviceClasses = map[string]bool{
+	DeviceClassBattery: true,
+	"battery_charging": true,
+	"carbon_monoxide":  true,
+	"cold":             true,
+	"connectivity":     true,
+	"door":             true,
+	"garage_door":      true,
+	"gas":              true,
+	"heat":             true,
+	"light":            true,
+	"lock":             true,
+	"moisture":         true,
+	"motion":           true,
+	"moving":           true,
+	"occupancy":        true,
+	"opening":          true,
+	"plug":             true,
+	DeviceClassPower:   true,
+	"presence":         true,
+	DeviceClassProblem: true,
+	DeviceClassRunning: true,
+	"safety":           true,
+	"smoke":            true,
+	"sound":            true,
+	"tamper":           true,
+	"update":           true,
+	"vibration":        true,
+	"window":           true,
+}
+
+var stateClasses = map[string]bool{
+	StateClassMeasurement:     true,
+	StateClassTotal:           true,
+	StateClassTotalIncreasing: true,
+}
+
+var entityCategories = map[string]bool{
+	EntityCategoryConfig:     true,
+	EntityCategoryDiagnostic: true,
+}
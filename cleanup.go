@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/exp/slog"
+)
+
+// DiscoveryTracker remembers the discovery topics which have been published by this instance.
+// They are persisted so that entities can be removed after their sensors have been deleted or renamed.
+type DiscoveryTracker struct {
+	topics map[string]bool
+}
+
+func NewDiscoveryTracker() (*DiscoveryTracker, error) {
+	t := &DiscoveryTracker{
+		topics: map[string]bool{},
+	}
+
+	var topics []string
+	if err := loadState("discovery", &topics); err != nil {
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		t.topics[topic] = true
+	}
+
+	return t, nil
+}
+
+// Add records a published discovery topic.
+func (t *DiscoveryTracker) Add(topic string) {
+	if t.topics[topic] {
+		return
+	}
+
+	t.topics[topic] = true
+	t.save()
+}
+
+func (t *DiscoveryTracker) remove(topic string) {
+	delete(t.topics, topic)
+}
+
+func (t *DiscoveryTracker) save() {
+	topics := []string{}
+	for topic := range t.topics {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	if err := saveState("discovery", topics); err != nil {
+		slog.Error("Failed to save discovery topics", slog.Any("error", err))
+	}
+}
+
+// ScanDiscovery collects the retained discovery configs which reference our availability topic.
+// Configs of other instances sharing the node IDs are ignored.
+func ScanDiscovery(c *MQTTClient, duration time.Duration) ([]string, error) {
+	connectDeadline := time.Now().Add(mqttOpts.ConnectTimeout)
+	for !c.IsConnectionOpen() {
+		if time.Now().After(connectDeadline) {
+			return nil, fmt.Errorf("not connected")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var (
+		topics []string
+		mutex  sync.Mutex
+	)
+
+	ours := availabilityTopic()
+	filter := fmt.Sprintf("%s/+/+/+/config", hassioMQTTDiscoveryPrefix)
+
+	token := c.Subscribe(filter, 1, func(_ mqtt.Client, m mqtt.Message) {
+		if !m.Retained() || len(m.Payload()) == 0 {
+			return
+		}
+
+		var cfg struct {
+			AvailabilityTopic string `json:"availability_topic"`
+		}
+
+		if err := json.Unmarshal(m.Payload(), &cfg); err != nil || cfg.AvailabilityTopic != ours {
+			return
+		}
+
+		mutex.Lock()
+		topics = append(topics, m.Topic())
+		mutex.Unlock()
+	})
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	// The broker sends retained messages right after subscribing
+	time.Sleep(duration)
+
+	if token := c.Unsubscribe(filter); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return topics, nil
+}
+
+// RemoveStaleEntities removes the entities of all tracked or scanned discovery topics which do not belong to a configured sensor.
+func RemoveStaleEntities(c *MQTTClient, tracker *DiscoveryTracker, scanned []string, sensors []Sensor, dryRun bool) {
+	configured := map[string]bool{}
+	for i := range sensors {
+		configured[sensors[i].Topic("config")] = true
+	}
+
+	stale := map[string]bool{}
+	for topic := range tracker.topics {
+		if !configured[topic] {
+			stale[topic] = true
+		}
+	}
+
+	for _, topic := range scanned {
+		if !configured[topic] {
+			stale[topic] = true
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	for topic := range stale {
+		if dryRun {
+			slog.Info("Found stale entity", slog.String("topic", topic))
+			continue
+		}
+
+		slog.Info("Removing stale entity", slog.String("topic", topic))
+
+		// An empty retained config removes the entity from Home Assistant
+		c.Publish(topic, mqttQoS, true, "")
+
+		tracker.remove(topic)
+	}
+
+	if !dryRun {
+		tracker.save()
+	}
+}
@@ -0,0 +1,321 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Update is a new value of a sensor.
+type Update struct {
+	Sensor    *Sensor
+	Value     float32
+	Time      time.Time
+	LastReset time.Time
+	Raw       []uint16 // Registers of Modbus sensors
+}
+
+// isFinite returns false for NaN and infinite values.
+// These are neither representable in JSON nor in the InfluxDB line protocol.
+func isFinite(v float32) bool {
+	return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+}
+
+type RegisterReader interface {
+	Register(addr uint16) (uint16, bool)
+}
+
+// Deriver calculates the value of a virtual sensor from its inputs.
+type Deriver interface {
+	Inputs() (ids []string, regs []uint16)
+	Evaluate(env Env, ts time.Time) (float64, error)
+}
+
+// StatefulDeriver is a deriver whose state is persisted across restarts.
+type StatefulDeriver interface {
+	Deriver
+
+	// State returns a pointer to the JSON-serializable state.
+	State() any
+}
+
+// ResettingDeriver is a deriver whose value is periodically reset.
+type ResettingDeriver interface {
+	Deriver
+
+	LastResetTime() time.Time
+}
+
+type exprDeriver struct {
+	Expr
+}
+
+func (d exprDeriver) Inputs() ([]string, []uint16) {
+	return ExprInputs(d.Expr)
+}
+
+func (d exprDeriver) Evaluate(env Env, _ time.Time) (float64, error) {
+	return d.Eval(env)
+}
+
+type computedSensor struct {
+	*Sensor
+	Deriver
+
+	regs  []uint16
+	owner string // First referenced sensor, empty if only raw registers are referenced
+}
+
+// Computer evaluates virtual sensors which are derived from other sensors or raw registers.
+// These are either expressions, integrations, meters or aggregates.
+//
+// Inputs are either produced by this process (local) or received from
+// another sniffer instance via MQTT (remote). Once a value has been produced
+// locally, remote updates for it are ignored so that our own publications
+// are not fed back.
+//
+// A virtual sensor is only evaluated and published by the instance which
+// owns it so that it is not published by multiple instances. The owner is
+// the instance which produces the first sensor referenced by the virtual
+// sensor. Once owned, both local and remote updates of any input trigger
+// a re-evaluation.
+type Computer struct {
+	sensors    []*computedSensor
+	dependents map[string][]*computedSensor
+	registers  RegisterReader
+
+	values map[string]float64
+	local  map[string]bool
+	inputs map[string]*Sensor
+}
+
+func NewComputer(sensors []Sensor, regs RegisterReader) (*Computer, error) {
+	c := &Computer{
+		dependents: map[string][]*computedSensor{},
+		registers:  regs,
+		values:     map[string]float64{},
+		local:      map[string]bool{},
+		inputs:     map[string]*Sensor{},
+	}
+
+	byID := map[string]*Sensor{}
+	for i := range sensors {
+		byID[sensors[i].ObjectID] = &sensors[i]
+	}
+
+	for i := range sensors {
+		s := &sensors[i]
+
+		cs := &computedSensor{
+			Sensor: s,
+		}
+
+		switch {
+		case s.Expression != "":
+			expr, err := ParseExpr(s.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expression of sensor %s: %w", s.ObjectID, err)
+			}
+
+			cs.Deriver = exprDeriver{expr}
+
+		case s.Integration != nil:
+			cs.Deriver = newIntegrator(s.Integration)
+
+		case s.Meter != nil:
+			m, err := newMeter(s.Meter)
+			if err != nil {
+				return nil, fmt.Errorf("invalid meter of sensor %s: %w", s.ObjectID, err)
+			}
+
+			cs.Deriver = m
+
+		case s.Aggregate != nil:
+			cs.Deriver = newAggregator(s.Aggregate)
+
+		default:
+			continue
+		}
+
+		ids, regs := cs.Inputs()
+		for _, id := range ids {
+			input, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("sensor %s references unknown sensor: %s", s.ObjectID, id)
+			}
+
+			c.inputs[id] = input
+			c.dependents[id] = append(c.dependents[id], cs)
+		}
+
+		cs.regs = regs
+		if len(ids) > 0 {
+			cs.owner = ids[0]
+		}
+
+		c.sensors = append(c.sensors, cs)
+	}
+
+	for _, cs := range c.sensors {
+		if err := c.checkCycle(cs, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Computer) checkCycle(cs *computedSensor, visited map[string]bool) error {
+	if visited[cs.ObjectID] {
+		return fmt.Errorf("sensor %s depends on itself", cs.ObjectID)
+	}
+
+	visited[cs.ObjectID] = true
+	defer delete(visited, cs.ObjectID)
+
+	for _, dep := range c.dependents[cs.ObjectID] {
+		if err := c.checkCycle(dep, visited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Inputs returns all sensors which are referenced by at least one virtual sensor.
+func (c *Computer) Inputs() []*Sensor {
+	inputs := []*Sensor{}
+	for _, s := range c.inputs {
+		inputs = append(inputs, s)
+	}
+
+	return inputs
+}
+
+// Update stores a new input value and returns the updates of all computed sensors depending on it.
+func (c *Computer) Update(id string, value float32, ts time.Time, local bool) []Update {
+	if !local && c.local[id] {
+		return nil
+	}
+
+	c.values[id] = float64(value)
+
+	if local {
+		c.local[id] = true
+	}
+
+	sensors := []*computedSensor{}
+	for _, cs := range c.dependents[id] {
+		if c.owns(cs) {
+			sensors = append(sensors, cs)
+		}
+	}
+
+	return c.evaluate(sensors, ts)
+}
+
+// UpdateRegisters re-evaluates all expressions which reference raw registers.
+func (c *Computer) UpdateRegisters(ts time.Time) []Update {
+	sensors := []*computedSensor{}
+	for _, cs := range c.sensors {
+		if len(cs.regs) > 0 && c.owns(cs) {
+			sensors = append(sensors, cs)
+		}
+	}
+
+	return c.evaluate(sensors, ts)
+}
+
+// owns returns true if the virtual sensor is evaluated by this instance.
+func (c *Computer) owns(cs *computedSensor) bool {
+	return cs.owner == "" || c.local[cs.owner]
+}
+
+func (c *Computer) evaluate(sensors []*computedSensor, ts time.Time) []Update {
+	updates := []Update{}
+
+	for _, cs := range sensors {
+		v, err := cs.Evaluate(c, ts)
+		if err != nil {
+			if !errors.Is(err, ErrUnknownValue) {
+				slog.Error("Failed to evaluate sensor",
+					slog.String("sensor", cs.ObjectID),
+					slog.Any("error", err))
+			}
+			continue
+		}
+
+		upd := Update{
+			Sensor: cs.Sensor,
+			Value:  float32(v),
+			Time:   ts,
+		}
+
+		if r, ok := cs.Deriver.(ResettingDeriver); ok {
+			upd.LastReset = r.LastResetTime()
+		}
+
+		updates = append(updates, upd)
+
+		updates = append(updates, c.Update(cs.ObjectID, float32(v), ts, true)...)
+	}
+
+	return updates
+}
+
+func (c *Computer) Value(id string) (float64, bool) {
+	v, ok := c.values[id]
+	return v, ok
+}
+
+func (c *Computer) Register(addr uint16) (uint16, bool) {
+	if c.registers == nil {
+		return 0, false
+	}
+
+	return c.registers.Register(addr)
+}
+
+// LoadState restores the state of all stateful derivers like integrations and meters from the state file.
+func (c *Computer) LoadState() error {
+	states := map[string]json.RawMessage{}
+	if err := loadState("computed", &states); err != nil {
+		return err
+	}
+
+	for _, cs := range c.sensors {
+		if d, ok := cs.Deriver.(StatefulDeriver); ok {
+			if st, ok := states[cs.ObjectID]; ok {
+				if err := json.Unmarshal(st, d.State()); err != nil {
+					return fmt.Errorf("invalid state of sensor %s: %w", cs.ObjectID, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// SaveState persists the state of all stateful derivers to the state file.
+func (c *Computer) SaveState() error {
+	states := map[string]any{}
+
+	for _, cs := range c.sensors {
+		if d, ok := cs.Deriver.(StatefulDeriver); ok {
+			states[cs.ObjectID] = d.State()
+		}
+	}
+
+	if len(states) == 0 {
+		return nil
+	}
+
+	return saveState("computed", states)
+}
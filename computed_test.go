@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputerOwner(t *testing.T) {
+	sensors := func() []Sensor {
+		return []Sensor{
+			{ObjectID: "pv_power"},
+			{ObjectID: "grid_power"},
+			{ObjectID: "house_power", Expression: "pv_power + grid_power"},
+		}
+	}
+
+	ts := time.Now()
+
+	// Instance decoding the first input publishes the computed sensor
+	pcs, err := NewComputer(sensors(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upds := pcs.Update("grid_power", -200, ts, false); len(upds) != 0 {
+		t.Errorf("unexpected updates before first local value: %v", upds)
+	}
+
+	upds := pcs.Update("pv_power", 1500, ts, true)
+	if len(upds) != 1 || upds[0].Sensor.ObjectID != "house_power" || upds[0].Value != 1300 {
+		t.Fatalf("unexpected updates: %v", upds)
+	}
+
+	// Remote updates of other inputs re-evaluate owned sensors
+	upds = pcs.Update("grid_power", 100, ts, false)
+	if len(upds) != 1 || upds[0].Value != 1600 {
+		t.Errorf("unexpected updates: %v", upds)
+	}
+
+	// Remote values of local inputs are ignored
+	if upds := pcs.Update("pv_power", 0, ts, false); len(upds) != 0 {
+		t.Errorf("unexpected updates: %v", upds)
+	}
+
+	// Instance decoding another input does not publish the computed sensor
+	pm, err := NewComputer(sensors(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm.Update("pv_power", 1500, ts, false)
+
+	if upds := pm.Update("grid_power", -200, ts, true); len(upds) != 0 {
+		t.Errorf("unexpected updates of non-owned sensor: %v", upds)
+	}
+}
+
+func TestComputerRegisters(t *testing.T) {
+	regs := testEnv{
+		registers: map[uint16]uint16{
+			0x10: 0xfffe,
+		},
+	}
+
+	c, err := NewComputer([]Sensor{
+		{ObjectID: "raw", Expression: "reg(0x10) * 10"},
+		{ObjectID: "double_raw", Expression: "raw * 2"},
+	}, regs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upds := c.UpdateRegisters(time.Now())
+	if len(upds) != 2 || upds[0].Value != -20 || upds[1].Value != -40 {
+		t.Errorf("unexpected updates: %v", upds)
+	}
+}
+
+func TestComputerErrors(t *testing.T) {
+	tests := [][]Sensor{
+		{{ObjectID: "a", Expression: "b + 1"}},
+		{{ObjectID: "a", Expression: "1 +"}},
+		{{ObjectID: "a", Expression: "b"}, {ObjectID: "b", Expression: "a"}},
+	}
+
+	for _, sensors := range tests {
+		if _, err := NewComputer(sensors, nil); err == nil {
+			t.Errorf("expected error for %v", sensors[0].Expression)
+		}
+	}
+}
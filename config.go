@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of the sensor definition file.
+type Config struct {
+	Devices map[string]*Device           `yaml:"devices,omitempty"`
+	Filters map[string]*FilterDefinition `yaml:"filters,omitempty"`
+	Sensors []Sensor                     `yaml:"sensors"`
+	Raw     *Raw                         `yaml:"raw,omitempty"`
+}
+
+// ReadConfig reads the sensor definition file.
+// For backwards compatibility, the file may also contain a plain list of sensors.
+func ReadConfig(fn string) (*Config, error) {
+	cfg := &Config{}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var n yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&n); err != nil {
+		return nil, err
+	}
+
+	if len(n.Content) > 0 && n.Content[0].Kind == yaml.SequenceNode {
+		err = n.Decode(&cfg.Sensors)
+	} else {
+		err = n.Decode(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.resolveDevices(); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Sensors {
+		s := &cfg.Sensors[i]
+
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("invalid sensor %s: %w", s.ObjectID, err)
+		}
+	}
+
+	for name, fd := range cfg.Filters {
+		for _, pattern := range fd.Sensors {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid sensor pattern in filter %s: %w", name, err)
+			}
+		}
+	}
+
+	if cfg.Raw != nil && cfg.Raw.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS level for raw transactions: %d", cfg.Raw.QoS)
+	}
+
+	return cfg, nil
+}
+
+// resolveDevices links the devices to their parents and assigns them to the sensors.
+func (c *Config) resolveDevices() error {
+	for key, d := range c.Devices {
+		if d == nil {
+			return fmt.Errorf("empty device: %s", key)
+		}
+
+		d.key = key
+
+		if err := d.validateInfo(); err != nil {
+			return fmt.Errorf("invalid device %s: %w", key, err)
+		}
+	}
+
+	for key, d := range c.Devices {
+		if d.ViaDevice == "" {
+			continue
+		}
+
+		via, ok := c.Devices[d.ViaDevice]
+		if !ok {
+			return fmt.Errorf("unknown via_device of device %s: %s", key, d.ViaDevice)
+		}
+
+		d.via = via
+	}
+
+	for key, d := range c.Devices {
+		for p, n := d.via, 0; p != nil; p, n = p.via, n+1 {
+			if p == d || n > len(c.Devices) {
+				return fmt.Errorf("cyclic via_device of device %s", key)
+			}
+		}
+	}
+
+	for i := range c.Sensors {
+		s := &c.Sensors[i]
+		if s.DeviceName == "" {
+			continue
+		}
+
+		d, ok := c.Devices[s.DeviceName]
+		if !ok {
+			return fmt.Errorf("unknown device of sensor %s: %s", s.ObjectID, s.DeviceName)
+		}
+
+		s.Device = d
+	}
+
+	return nil
+}
+
+// Filter returns the global filters and the per-sensor filters for the given filter names.
+func (c *Config) Filter(names []string) (Filter, map[*Sensor]Filter, error) {
+	global := Filters{}
+	sensors := map[*Sensor]Filter{}
+
+	for _, name := range names {
+		fd, ok := c.Filters[name]
+		if !ok {
+			if fd, ok = builtinFilter(name); !ok {
+				return nil, nil, fmt.Errorf("unknown filter: %s", name)
+			}
+		}
+
+		if fd.Global() {
+			global = append(global, fd)
+			continue
+		}
+
+		for i := range c.Sensors {
+			s := &c.Sensors[i]
+
+			if fd.Applies(s) {
+				fs, _ := sensors[s].(Filters)
+				sensors[s] = append(fs, fd)
+			}
+		}
+	}
+
+	if len(global) == 0 {
+		return nil, sensors, nil
+	}
+
+	return global, sensors, nil
+}
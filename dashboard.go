@@ -0,0 +1,228 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// Sensors shown on the dashboard
+var dashboardSensors []Sensor
+
+type ResponseOverview struct {
+	Time      time.Time        `json:"time"`
+	Available bool             `json:"available"`
+	History   bool             `json:"history"`
+	Tracees   []OverviewTracee `json:"tracees"`
+	Bus       OverviewBus      `json:"bus"`
+	Sensors   []OverviewSensor `json:"sensors"`
+}
+
+type OverviewTracee struct {
+	Pid      int          `json:"pid"`
+	Attached bool         `json:"attached"`
+	Fds      []OverviewFd `json:"fds"`
+}
+
+type OverviewFd struct {
+	Fd    int    `json:"fd"`
+	Read  uint64 `json:"read"`
+	Write uint64 `json:"write"`
+}
+
+type OverviewBus struct {
+	FramesDecoded  uint64         `json:"frames_decoded"`
+	FramesFiltered uint64         `json:"frames_filtered"`
+	CRCErrors      uint64         `json:"crc_errors"`
+	DecodeErrors   uint64         `json:"decode_errors"`
+	Backlog        int            `json:"backlog"`
+	MQTTPublishes  uint64         `json:"mqtt_publishes"`
+	MQTTFailures   uint64         `json:"mqtt_failures"`
+	PublishDropped uint64         `json:"publish_dropped"` // Due to the publish budget
+	MQTTQueue      *OverviewQueue `json:"mqtt_queue,omitempty"`
+	Units          []OverviewUnit `json:"units"`
+}
+
+type OverviewQueue struct {
+	Length  int    `json:"length"`
+	Queued  uint64 `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type OverviewUnit struct {
+	Unit         byte    `json:"unit"`
+	Transactions uint64  `json:"transactions"`
+	Latency      float64 `json:"latency"` // Average in seconds
+}
+
+type OverviewSensor struct {
+	ObjectID          string            `json:"object_id"`
+	Name              string            `json:"name,omitempty"`
+	UnitOfMeasurement string            `json:"unit_of_measurement,omitempty"`
+	Device            string            `json:"device,omitempty"`
+	Component         string            `json:"component"`
+	Precision         *int              `json:"precision,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"` // Options of enum sensors by value
+	Value             *float32          `json:"value,omitempty"`
+	Time              *time.Time        `json:"time,omitempty"`
+	Rejected          map[string]uint64 `json:"rejected,omitempty"` // Implausible values by reason
+}
+
+func httpHandleApiOverview(w http.ResponseWriter, req *http.Request) {
+	snap := metrics.Snapshot()
+	values := stateStore.Snapshot().Values
+
+	resp := ResponseOverview{
+		Time:      time.Now(),
+		Available: snap.Available,
+		History:   history != nil,
+		Tracees:   []OverviewTracee{},
+		Sensors:   []OverviewSensor{},
+		Bus: OverviewBus{
+			FramesDecoded:  snap.FramesDecoded,
+			FramesFiltered: snap.FramesFiltered,
+			CRCErrors:      snap.CRCErrors,
+			DecodeErrors:   snap.DecodeErrors,
+			Backlog:        snap.Backlog,
+			MQTTPublishes:  snap.MQTTPublishes,
+			MQTTFailures:   snap.MQTTFailures,
+			PublishDropped: snap.PublishDropped,
+			Units:          []OverviewUnit{},
+		},
+	}
+
+	if q := snap.MQTTQueue; q != nil {
+		resp.Bus.MQTTQueue = &OverviewQueue{
+			Length:  q.Length,
+			Queued:  q.Queued,
+			Dropped: q.Dropped,
+		}
+	}
+
+	// Tracees and their file descriptors
+	tracees := map[int]*OverviewTracee{}
+	tracee := func(pid int) *OverviewTracee {
+		t, ok := tracees[pid]
+		if !ok {
+			t = &OverviewTracee{
+				Pid: pid,
+				Fds: []OverviewFd{},
+			}
+			tracees[pid] = t
+		}
+		return t
+	}
+
+	for pid, attached := range snap.Tracees {
+		tracee(pid).Attached = attached
+	}
+
+	fds := map[[2]int]*OverviewFd{}
+	for k, n := range snap.Messages {
+		fd, ok := fds[[2]int{k.pid, k.fd}]
+		if !ok {
+			fd = &OverviewFd{Fd: k.fd}
+			fds[[2]int{k.pid, k.fd}] = fd
+		}
+
+		if k.direction == DirectionRead {
+			fd.Read += n
+		} else {
+			fd.Write += n
+		}
+	}
+
+	for k, fd := range fds {
+		t := tracee(k[0])
+		t.Fds = append(t.Fds, *fd)
+	}
+
+	for _, t := range tracees {
+		sort.Slice(t.Fds, func(i, j int) bool {
+			return t.Fds[i].Fd < t.Fds[j].Fd
+		})
+
+		resp.Tracees = append(resp.Tracees, *t)
+	}
+
+	sort.Slice(resp.Tracees, func(i, j int) bool {
+		return resp.Tracees[i].Pid < resp.Tracees[j].Pid
+	})
+
+	// Units
+	for unit, h := range snap.Latency {
+		u := OverviewUnit{
+			Unit:         unit,
+			Transactions: h.count,
+		}
+
+		if h.count > 0 {
+			u.Latency = h.sum / float64(h.count)
+		}
+
+		resp.Bus.Units = append(resp.Bus.Units, u)
+	}
+
+	sort.Slice(resp.Bus.Units, func(i, j int) bool {
+		return resp.Bus.Units[i].Unit < resp.Bus.Units[j].Unit
+	})
+
+	// Sensors
+	for i := range dashboardSensors {
+		s := &dashboardSensors[i]
+
+		e := OverviewSensor{
+			ObjectID:          s.ObjectID,
+			Name:              s.Name,
+			UnitOfMeasurement: s.UnitOfMeasurement,
+			Component:         s.Component,
+			Precision:         s.SuggestedDisplayPrecision,
+			Rejected:          snap.Rejected[s.ObjectID],
+		}
+
+		if s.Device != nil {
+			e.Device = s.Device.Name
+		}
+
+		if s.DeviceClass == DeviceClassEnum {
+			e.Labels = map[string]string{}
+			for _, o := range s.Options {
+				e.Labels[strconv.FormatInt(o.Value, 10)] = o.Label
+			}
+		}
+
+		if v, ok := values[s]; ok && isFinite(v.Value) {
+			e.Value = &v.Value
+			e.Time = &v.Time
+		}
+
+		resp.Sensors = append(resp.Sensors, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		slog.Error("Failed to write response", slog.Any("error", err))
+	}
+}
+
+func httpHandleDashboard() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(root))
+}
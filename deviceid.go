@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/howeyc/crc16"
+)
+
+const (
+	FunctionCodeEncapsulatedInterface         = 0x2b
+	MEITypeReadDeviceIdentification           = 0x0e
+	DeviceIdentificationObjectVendorName      = 0x00
+	DeviceIdentificationObjectProductCode     = 0x01
+	DeviceIdentificationObjectRevision        = 0x02
+	DeviceIdentificationObjectVendorURL       = 0x03
+	DeviceIdentificationObjectProductName     = 0x04
+	DeviceIdentificationObjectModelName       = 0x05
+	DeviceIdentificationObjectApplicationName = 0x06
+)
+
+// ReadDeviceIdentificationRequest is a Modbus encapsulated interface transport request (function code 43 / MEI type 14).
+type ReadDeviceIdentificationRequest struct {
+	Unit         byte
+	FunctionCode byte
+	MEIType      byte
+	ReadDeviceID byte
+	ObjectID     byte
+	Checksum     uint16
+}
+
+type ReadDeviceIdentificationResponse struct {
+	Unit         byte
+	FunctionCode byte
+	MEIType      byte
+	ReadDeviceID byte
+	Conformity   byte
+	MoreFollows  byte
+	NextObjectID byte
+	Objects      map[byte]string
+	Checksum     uint16
+}
+
+func isReadDeviceIdentification(b []byte) bool {
+	return len(b) >= 3 && b[1] == FunctionCodeEncapsulatedInterface && b[2] == MEITypeReadDeviceIdentification
+}
+
+func NewReadDeviceIdentificationRequest(b []byte) (*ReadDeviceIdentificationRequest, []byte, error) {
+	if len(b) < 7 {
+		return nil, nil, ErrNotEnoughData
+	}
+
+	if !isReadDeviceIdentification(b) {
+		return nil, nil, fmt.Errorf("invalid function code: %d", b[1])
+	}
+
+	r := &ReadDeviceIdentificationRequest{
+		Unit:         b[0],
+		FunctionCode: b[1],
+		MEIType:      b[2],
+		ReadDeviceID: b[3],
+		ObjectID:     b[4],
+		Checksum:     binary.LittleEndian.Uint16(b[5:7]),
+	}
+
+	if r.Checksum != ^crc16.ChecksumIBM(b[0:5]) {
+		return nil, nil, ErrInvalidChecksum
+	}
+
+	return r, b[7:], nil
+}
+
+func NewReadDeviceIdentificationResponse(b []byte) (*ReadDeviceIdentificationResponse, []byte, error) {
+	if len(b) < 8 {
+		return nil, nil, ErrNotEnoughData
+	}
+
+	if !isReadDeviceIdentification(b) {
+		return nil, nil, fmt.Errorf("invalid function code: %d", b[1])
+	}
+
+	r := &ReadDeviceIdentificationResponse{
+		Unit:         b[0],
+		FunctionCode: b[1],
+		MEIType:      b[2],
+		ReadDeviceID: b[3],
+		Conformity:   b[4],
+		MoreFollows:  b[5],
+		NextObjectID: b[6],
+		Objects:      map[byte]string{},
+	}
+
+	num := int(b[7])
+	off := 8
+
+	for i := 0; i < num; i++ {
+		if len(b) < off+2 {
+			return nil, nil, ErrNotEnoughData
+		}
+
+		id := b[off]
+		l := int(b[off+1])
+
+		if len(b) < off+2+l {
+			return nil, nil, ErrNotEnoughData
+		}
+
+		r.Objects[id] = string(b[off+2 : off+2+l])
+		off += 2 + l
+	}
+
+	if len(b) < off+2 {
+		return nil, nil, ErrNotEnoughData
+	}
+
+	r.Checksum = binary.LittleEndian.Uint16(b[off : off+2])
+
+	if r.Checksum != ^crc16.ChecksumIBM(b[0:off]) {
+		return nil, nil, ErrInvalidChecksum
+	}
+
+	return r, b[off+2:], nil
+}
@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	DeviceInfoTypeString  = "string"
+	DeviceInfoTypeInteger = "integer"
+)
+
+// DeviceInfoSource references the registers or device identification object from which a device info field is read.
+type DeviceInfoSource struct {
+	Register *uint16 `yaml:"register,omitempty"`
+	Size     int     `yaml:"size,omitempty"`
+	Type     string  `yaml:"type,omitempty"`
+
+	// Object ID of a read device identification response (function code 43)
+	Object *byte `yaml:"object,omitempty"`
+}
+
+func (s *DeviceInfoSource) validate() error {
+	if (s.Register == nil) == (s.Object == nil) {
+		return errors.New("exactly one of register or object must be defined")
+	}
+
+	if s.Register != nil {
+		if s.Size == 0 {
+			s.Size = 1
+		}
+
+		switch s.Type {
+		case "":
+			s.Type = DeviceInfoTypeString
+		case DeviceInfoTypeString:
+		case DeviceInfoTypeInteger:
+			if s.Size > 4 {
+				return errors.New("integers span at most 4 registers")
+			}
+		default:
+			return fmt.Errorf("invalid type: %s", s.Type)
+		}
+	}
+
+	return nil
+}
+
+// read returns the value of the source if it has already been observed on the bus.
+func (s *DeviceInfoSource) read(dec *Decoder) (string, bool) {
+	if s.Object != nil {
+		v, ok := dec.Object(*s.Object)
+		return strings.TrimSpace(v), ok
+	}
+
+	regs := []uint16{}
+	for i := 0; i < s.Size; i++ {
+		r, ok := dec.Register(*s.Register + uint16(i))
+		if !ok {
+			return "", false
+		}
+
+		regs = append(regs, r)
+	}
+
+	if s.Type == DeviceInfoTypeInteger {
+		var v uint64
+		for _, r := range regs {
+			v = v<<16 | uint64(r)
+		}
+
+		return strconv.FormatUint(v, 10), true
+	}
+
+	b := make([]byte, 2*len(regs))
+	for i, r := range regs {
+		binary.BigEndian.PutUint16(b[2*i:], r)
+	}
+
+	return strings.TrimSpace(strings.Trim(string(b), "\x00")), true
+}
+
+// infoField returns the device info field which can be populated automatically.
+func (d *Device) infoField(name string) *string {
+	switch name {
+	case "manufacturer":
+		return &d.Manufacturer
+	case "model":
+		return &d.Model
+	case "serial_number":
+		return &d.SerialNumber
+	case "sw_version":
+		return &d.SoftwareVersion
+	case "hw_version":
+		return &d.HardwareVersion
+	}
+
+	return nil
+}
+
+func (d *Device) validateInfo() error {
+	for name, src := range d.Info {
+		if d.infoField(name) == nil {
+			return fmt.Errorf("unsupported info field: %s", name)
+		}
+
+		if src == nil {
+			return fmt.Errorf("empty info field: %s", name)
+		}
+
+		if err := src.validate(); err != nil {
+			return fmt.Errorf("invalid info field %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// DeviceInfoUpdater fills in the device metadata once the referenced registers or objects have been observed.
+type DeviceInfoUpdater struct {
+	devices []*Device
+	dec     *Decoder
+}
+
+func NewDeviceInfoUpdater(sensors []Sensor, dec *Decoder) *DeviceInfoUpdater {
+	u := &DeviceInfoUpdater{
+		dec: dec,
+	}
+
+	seen := map[*Device]bool{}
+	for i := range sensors {
+		d := sensors[i].Device
+		if d == nil || seen[d] || len(d.Info) == 0 {
+			continue
+		}
+
+		seen[d] = true
+		u.devices = append(u.devices, d)
+	}
+
+	return u
+}
+
+// Update returns the devices whose metadata changed.
+func (u *DeviceInfoUpdater) Update() []*Device {
+	changed := []*Device{}
+
+	for _, d := range u.devices {
+		updated := false
+
+		for name, src := range d.Info {
+			v, ok := src.read(u.dec)
+			if !ok || v == "" {
+				continue
+			}
+
+			if f := d.infoField(name); *f != v {
+				slog.Info("Updated device info",
+					slog.String("device", d.Name),
+					slog.String("field", name),
+					slog.String("value", v))
+
+				stream.Event("device_info", "Updated device info", "", "device", d.Name, "field", name, "value", v)
+
+				*f = v
+				updated = true
+			}
+		}
+
+		if updated {
+			changed = append(changed, d)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	StateModeSensor = "sensor" // One state topic per sensor
+	StateModeDevice = "device" // One JSON state topic per instance
+)
+
+// deviceStateTopic returns the topic on which this instance publishes the values of all sensors of a device.
+// Like the availability topic, it includes the client ID as multiple instances share the same node ID.
+// Devices from the configuration file get a sub-topic.
+func deviceStateTopic(d *Device) string {
+	if d == nil || d.key == "" {
+		return fmt.Sprintf("%s/%s/%s/state", hassioMQTTDiscoveryPrefix, hassioMQTTNodeID, mqttOpts.ClientID)
+	}
+
+	nodeID := hassioMQTTNodeID
+	if d.NodeID != "" {
+		nodeID = d.NodeID
+	}
+
+	return fmt.Sprintf("%s/%s/%s/state/%s", hassioMQTTDiscoveryPrefix, nodeID, mqttOpts.ClientID, d.key)
+}
+
+// DeviceStatePayload is published to the device state topic.
+type DeviceStatePayload struct {
+	Time      time.Time                  `json:"time"`
+	Values    map[string]json.RawMessage `json:"values"`
+	Registers map[string][]uint16        `json:"registers,omitempty"`
+}
+
+// DeviceState collects the values of all sensors of this instance.
+//
+// The values of a poll cycle are published together as a single JSON object
+// per device which always contains the last value of each of its sensors.
+// Hence, the discovery configs can pick their fields without running into
+// missing keys.
+type DeviceState struct {
+	last    map[*Sensor]Update
+	time    map[*Device]time.Time
+	changed map[*Device]bool
+}
+
+func NewDeviceState() *DeviceState {
+	return &DeviceState{
+		last:    map[*Sensor]Update{},
+		time:    map[*Device]time.Time{},
+		changed: map[*Device]bool{},
+	}
+}
+
+// Update stores a new sensor value until the next flush.
+func (d *DeviceState) Update(upd Update) {
+	dev := upd.Sensor.Device
+
+	d.last[upd.Sensor] = upd
+	d.changed[dev] = true
+
+	if upd.Time.After(d.time[dev]) {
+		d.time[dev] = upd.Time
+	}
+}
+
+// Flush publishes the states of all devices with values which changed since the last flush.
+func (d *DeviceState) Flush(c mqtt.Client) {
+	for dev, changed := range d.changed {
+		if changed {
+			d.send(c, dev)
+		}
+	}
+}
+
+// Send publishes the states of all devices.
+func (d *DeviceState) Send(c mqtt.Client) {
+	for dev := range d.time {
+		d.send(c, dev)
+	}
+}
+
+func (d *DeviceState) send(c mqtt.Client, dev *Device) {
+	payload, err := json.Marshal(d.Payload(dev))
+	if err != nil {
+		slog.Error("Failed to marshal device state", slog.Any("error", err))
+		return
+	}
+
+	c.Publish(deviceStateTopic(dev), mqttQoS, mqttRetain, payload)
+
+	d.changed[dev] = false
+}
+
+func (d *DeviceState) Payload(dev *Device) *DeviceStatePayload {
+	p := &DeviceStatePayload{
+		Time:      d.time[dev],
+		Values:    map[string]json.RawMessage{},
+		Registers: map[string][]uint16{},
+	}
+
+	for sensor, upd := range d.last {
+		if sensor.Device != dev {
+			continue
+		}
+
+		p.Values[sensor.ObjectID] = sensor.stateJSON(upd)
+
+		if upd.Raw != nil {
+			p.Registers[sensor.ObjectID] = upd.Raw
+		}
+	}
+
+	return p
+}
+
+// SubscribeDeviceStates subscribes to the device state topics of all instances.
+// This allows to receive values which are published by another sniffer instance.
+func SubscribeDeviceStates(c *MQTTClient, sensors []*Sensor, cb func(sensor *Sensor, value float32)) error {
+	handler := func(_ mqtt.Client, m mqtt.Message) {
+		var p DeviceStatePayload
+		if err := json.Unmarshal(m.Payload(), &p); err != nil {
+			slog.Warn("Received invalid device state", slog.String("topic", m.Topic()), slog.Any("error", err))
+			return
+		}
+
+		for _, sensor := range sensors {
+			raw, ok := p.Values[sensor.ObjectID]
+			if !ok {
+				continue
+			}
+
+			value, err := sensor.parseState(raw)
+			if err != nil {
+				slog.Warn("Received invalid state", slog.String("topic", m.Topic()), slog.String("id", sensor.ObjectID), slog.Any("error", err))
+				continue
+			}
+
+			cb(sensor, value)
+		}
+	}
+
+	for _, topic := range []string{
+		fmt.Sprintf("%s/+/+/state", hassioMQTTDiscoveryPrefix),
+		fmt.Sprintf("%s/+/+/state/+", hassioMQTTDiscoveryPrefix),
+	} {
+		if err := c.AddSubscription(topic, 1, handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
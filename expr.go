@@ -0,0 +1,416 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrUnknownValue    = errors.New("value not available")
+	ErrUnknownFunction = errors.New("unknown function")
+)
+
+// Env provides the inputs of an expression.
+type Env interface {
+	Value(id string) (float64, bool)
+	Register(addr uint16) (uint16, bool)
+}
+
+// Expr is a parsed arithmetic expression over sensor values and raw registers.
+//
+// Supported are the operators + - * / and parentheses, numeric literals
+// (decimal or 0x-prefixed hexadecimal), sensor object IDs and the functions
+// abs(x), min(x, ...), max(x, ...), reg(addr) and reg32(addr).
+// The latter two return the signed 16-bit and 32-bit value of raw registers.
+type Expr interface {
+	Eval(env Env) (float64, error)
+}
+
+type exprNumber float64
+
+type exprIdent string
+
+type exprUnary struct {
+	op rune
+	x  Expr
+}
+
+type exprBinary struct {
+	op   rune
+	x, y Expr
+}
+
+type exprCall struct {
+	fn   string
+	args []Expr
+}
+
+func (e exprNumber) Eval(Env) (float64, error) {
+	return float64(e), nil
+}
+
+func (e exprIdent) Eval(env Env) (float64, error) {
+	v, ok := env.Value(string(e))
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownValue, e)
+	}
+
+	return v, nil
+}
+
+func (e *exprUnary) Eval(env Env) (float64, error) {
+	x, err := e.x.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	return -x, nil
+}
+
+func (e *exprBinary) Eval(env Env) (float64, error) {
+	x, err := e.x.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	y, err := e.y.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	case '/':
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return x / y, nil
+	}
+
+	return 0, fmt.Errorf("invalid operator: %c", e.op)
+}
+
+func (e *exprCall) Eval(env Env) (float64, error) {
+	switch e.fn {
+	case "reg", "reg32":
+		addr, err := e.args[0].Eval(env)
+		if err != nil {
+			return 0, err
+		}
+
+		return evalRegister(env, uint16(addr), e.fn == "reg32")
+	}
+
+	args := []float64{}
+	for _, a := range e.args {
+		v, err := a.Eval(env)
+		if err != nil {
+			return 0, err
+		}
+
+		args = append(args, v)
+	}
+
+	switch e.fn {
+	case "abs":
+		return math.Abs(args[0]), nil
+
+	case "min":
+		m := args[0]
+		for _, v := range args[1:] {
+			m = math.Min(m, v)
+		}
+		return m, nil
+
+	case "max":
+		m := args[0]
+		for _, v := range args[1:] {
+			m = math.Max(m, v)
+		}
+		return m, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownFunction, e.fn)
+}
+
+func evalRegister(env Env, addr uint16, wide bool) (float64, error) {
+	hi, ok := env.Register(addr)
+	if !ok {
+		return 0, fmt.Errorf("%w: register %#x", ErrUnknownValue, addr)
+	}
+
+	if !wide {
+		return float64(int16(hi)), nil
+	}
+
+	lo, ok := env.Register(addr + 1)
+	if !ok {
+		return 0, fmt.Errorf("%w: register %#x", ErrUnknownValue, addr+1)
+	}
+
+	return float64(int32(uint32(hi)<<16 | uint32(lo))), nil
+}
+
+// ExprInputs returns the sensor object IDs and raw register addresses referenced by an expression.
+func ExprInputs(e Expr) (ids []string, regs []uint16) {
+	switch e := e.(type) {
+	case exprIdent:
+		ids = append(ids, string(e))
+
+	case *exprUnary:
+		return ExprInputs(e.x)
+
+	case *exprBinary:
+		ids, regs = ExprInputs(e.x)
+		ids2, regs2 := ExprInputs(e.y)
+		ids = append(ids, ids2...)
+		regs = append(regs, regs2...)
+
+	case *exprCall:
+		if e.fn == "reg" || e.fn == "reg32" {
+			addr := uint16(e.args[0].(exprNumber))
+			regs = append(regs, addr)
+			if e.fn == "reg32" {
+				regs = append(regs, addr+1)
+			}
+			break
+		}
+
+		for _, a := range e.args {
+			ids2, regs2 := ExprInputs(a)
+			ids = append(ids, ids2...)
+			regs = append(regs, regs2...)
+		}
+	}
+
+	return ids, regs
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// ParseExpr parses an arithmetic expression.
+func ParseExpr(s string) (Expr, error) {
+	p := &exprParser{s: s}
+
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected character '%c' at position %d", p.s[p.pos], p.pos)
+	}
+
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() rune {
+	p.skipSpace()
+
+	if p.pos >= len(p.s) {
+		return 0
+	}
+
+	return rune(p.s[p.pos])
+}
+
+func (p *exprParser) parseSum() (Expr, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+
+		x = &exprBinary{op, x, y}
+	}
+
+	return x, nil
+}
+
+func (p *exprParser) parseProduct() (Expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		x = &exprBinary{op, x, y}
+	}
+
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &exprUnary{'-', x}, nil
+
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	c := p.peek()
+
+	switch {
+	case c == '(':
+		p.pos++
+
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+
+		return x, nil
+
+	case c == '.' || unicode.IsDigit(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isIdentChar(rune(p.s[p.pos])) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+
+		lit := p.s[start:p.pos]
+
+		if strings.HasPrefix(lit, "0x") || strings.HasPrefix(lit, "0X") {
+			v, err := strconv.ParseUint(lit[2:], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number: %s", lit)
+			}
+
+			return exprNumber(v), nil
+		}
+
+		v, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", lit)
+		}
+
+		return exprNumber(v), nil
+
+	case isIdentChar(c):
+		start := p.pos
+		for p.pos < len(p.s) && isIdentChar(rune(p.s[p.pos])) {
+			p.pos++
+		}
+
+		name := p.s[start:p.pos]
+
+		if p.peek() != '(' {
+			return exprIdent(name), nil
+		}
+		p.pos++
+
+		return p.parseCall(name)
+
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected character '%c' at position %d", c, p.pos)
+}
+
+func (p *exprParser) parseCall(fn string) (Expr, error) {
+	call := &exprCall{fn: fn}
+
+	if p.peek() != ')' {
+		for {
+			a, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+
+			call.args = append(call.args, a)
+
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+	}
+	p.pos++
+
+	switch fn {
+	case "abs":
+		if len(call.args) != 1 {
+			return nil, fmt.Errorf("%s() expects one argument", fn)
+		}
+
+	case "min", "max":
+		if len(call.args) < 1 {
+			return nil, fmt.Errorf("%s() expects at least one argument", fn)
+		}
+
+	case "reg", "reg32":
+		if len(call.args) != 1 {
+			return nil, fmt.Errorf("%s() expects one argument", fn)
+		}
+
+		if _, ok := call.args[0].(exprNumber); !ok {
+			return nil, fmt.Errorf("%s() expects a constant register address", fn)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFunction, fn)
+	}
+
+	return call, nil
+}
+
+func isIdentChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testEnv struct {
+	values    map[string]float64
+	registers map[uint16]uint16
+}
+
+func (e testEnv) Value(id string) (float64, bool) {
+	v, ok := e.values[id]
+	return v, ok
+}
+
+func (e testEnv) Register(addr uint16) (uint16, bool) {
+	r, ok := e.registers[addr]
+	return r, ok
+}
+
+func TestExprEval(t *testing.T) {
+	env := testEnv{
+		values: map[string]float64{
+			"pv_power":   1500,
+			"grid_power": -200,
+		},
+		registers: map[uint16]uint16{
+			0x10: 0xffff,
+			0x11: 0xfffe,
+			0x20: 0x0001,
+			0x21: 0x0000,
+		},
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 4 / 3", 1},
+		{"-3 * -2", 6},
+		{"+4", 4},
+		{"--4", 4},
+		{"0x10 + 1", 17},
+		{".5 * 4", 2},
+		{"abs(-7)", 7},
+		{"min(3, 1, 2)", 1},
+		{"max(3, 1, 2)", 3},
+		{"max(0, -grid_power)", 200},
+		{"pv_power + grid_power", 1300},
+		{" pv_power*2 ", 3000},
+		{"reg(0x10)", -1},
+		{"reg32(0x10)", -2},
+		{"reg32(0x20)", 65536},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%q: failed to parse: %s", tt.expr, err)
+			continue
+		}
+
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%q: failed to evaluate: %s", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	env := testEnv{
+		values: map[string]float64{
+			"zero": 0,
+		},
+	}
+
+	tests := []struct {
+		expr    string
+		unknown bool
+	}{
+		{"1 / zero", false},
+		{"missing + 1", true},
+		{"reg(0x10)", true},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%q: failed to parse: %s", tt.expr, err)
+			continue
+		}
+
+		_, err = e.Eval(env)
+		if err == nil {
+			t.Errorf("%q: expected error", tt.expr)
+		} else if errors.Is(err, ErrUnknownValue) != tt.unknown {
+			t.Errorf("%q: unexpected error: %s", tt.expr, err)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 $ 2",
+		"0xzz",
+		"1.2.3",
+		"abs()",
+		"abs(1, 2)",
+		"min()",
+		"reg(a)",
+		"reg32()",
+		"sqrt(4)",
+		"max(1,",
+	}
+
+	for _, expr := range tests {
+		if _, err := ParseExpr(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestExprInputs(t *testing.T) {
+	e, err := ParseExpr("max(0, pv_power - reg(0x10)) + -grid_power * reg32(0x20) / pv_power")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, regs := ExprInputs(e)
+
+	if want := []string{"pv_power", "grid_power", "pv_power"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+
+	if want := []uint16{0x10, 0x20, 0x21}; !reflect.DeepEqual(regs, want) {
+		t.Errorf("regs = %v, want %v", regs, want)
+	}
+}
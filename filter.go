@@ -3,31 +3,244 @@
 
 package main
 
+import (
+	"fmt"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
 type Filter interface {
-	Filter(req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool
+	Filter(m *Message, req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool
 }
 
-type PCSFilter struct {
-	lastResponse *ReadHoldingRegistersResponse
+// Filters accepts a response only if all of its filters accept it.
+type Filters []Filter
+
+func (fs Filters) Filter(m *Message, req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool {
+	for _, f := range fs {
+		if !f.Filter(m, req, resp) {
+			return false
+		}
+	}
+
+	return true
 }
 
-func (p *PCSFilter) Filter(req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool {
-	if p.lastResponse == nil {
-		p.lastResponse = resp
-		return false
+// Interval is an inclusive range of values.
+// Both bounds are optional.
+type Interval struct {
+	Min *int64 `yaml:"min,omitempty"`
+	Max *int64 `yaml:"max,omitempty"`
+}
+
+func (i Interval) Contains(v int64) bool {
+	return (i.Min == nil || v >= *i.Min) && (i.Max == nil || v <= *i.Max)
+}
+
+// ValueMatch matches a value against a list of intervals.
+//
+// In YAML it is either a single value, an interval with min and/or max,
+// or a list of those of which at least one must match.
+type ValueMatch []Interval
+
+func (vm *ValueMatch) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		var v int64
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+
+		*vm = ValueMatch{{Min: &v, Max: &v}}
+
+	case yaml.MappingNode:
+		var i Interval
+		if err := n.Decode(&i); err != nil {
+			return err
+		}
+
+		*vm = ValueMatch{i}
+
+	case yaml.SequenceNode:
+		*vm = ValueMatch{}
+
+		for _, c := range n.Content {
+			var m ValueMatch
+			if err := c.Decode(&m); err != nil {
+				return err
+			}
+
+			*vm = append(*vm, m...)
+		}
+
+	default:
+		return fmt.Errorf("invalid value match at line %d", n.Line)
+	}
+
+	return nil
+}
+
+func (vm ValueMatch) Match(v int64) bool {
+	for _, i := range vm {
+		if i.Contains(v) {
+			return true
+		}
 	}
 
-	if len(resp.Registers) < 92 {
+	return false
+}
+
+// RegisterMatch matches the signed value of a 16-bit or 32-bit register in the response.
+type RegisterMatch struct {
+	Address uint16     `yaml:"address"`
+	Size    int        `yaml:"size,omitempty"`
+	Value   ValueMatch `yaml:"value"`
+}
+
+func (rm *RegisterMatch) Match(req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool {
+	size := rm.Size
+	if size == 0 {
+		size = 1
+	}
+
+	off := int(rm.Address) - int(req.Address)
+	if off < 0 || off+size > len(resp.Registers) {
 		return false
 	}
 
-	if req.Address != 0x9c72 {
+	regs := resp.Registers[off : off+size]
+
+	var v int64
+	switch size {
+	case 1:
+		v = int64(int16(regs[0]))
+	case 2:
+		v = int64(int32(uint32(regs[0])<<16 | uint32(regs[1])))
+	default:
 		return false
 	}
 
-	if int32(resp.Registers[50])<<16+int32(resp.Registers[51]) <= 0 {
+	return rm.Value.Match(v)
+}
+
+// FilterRule is a declarative filter.
+//
+// All predicates which are set must match.
+// Rules can be combined with all (and), any (or) and not.
+type FilterRule struct {
+	All []*FilterRule `yaml:"all,omitempty"`
+	Any []*FilterRule `yaml:"any,omitempty"`
+	Not *FilterRule   `yaml:"not,omitempty"`
+
+	Unit         ValueMatch      `yaml:"unit,omitempty"`
+	FunctionCode ValueMatch      `yaml:"function_code,omitempty"`
+	Address      ValueMatch      `yaml:"address,omitempty"`
+	Count        ValueMatch      `yaml:"count,omitempty"`
+	Pid          ValueMatch      `yaml:"pid,omitempty"`
+	Fd           ValueMatch      `yaml:"fd,omitempty"`
+	Registers    []RegisterMatch `yaml:"registers,omitempty"`
+}
+
+func (r *FilterRule) Filter(m *Message, req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool {
+	for _, s := range r.All {
+		if !s.Filter(m, req, resp) {
+			return false
+		}
+	}
+
+	if len(r.Any) > 0 {
+		matched := false
+		for _, s := range r.Any {
+			if s.Filter(m, req, resp) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if r.Not != nil && r.Not.Filter(m, req, resp) {
 		return false
 	}
 
+	for _, p := range []struct {
+		match ValueMatch
+		value int64
+	}{
+		{r.Unit, int64(req.Unit)},
+		{r.FunctionCode, int64(resp.FunctionCode)},
+		{r.Address, int64(req.Address)},
+		{r.Count, int64(len(resp.Registers))},
+		{r.Pid, int64(m.Pid)},
+		{r.Fd, int64(m.Fd)},
+	} {
+		if p.match != nil && !p.match.Match(p.value) {
+			return false
+		}
+	}
+
+	for i := range r.Registers {
+		if !r.Registers[i].Match(req, resp) {
+			return false
+		}
+	}
+
 	return true
 }
+
+// FilterDefinition is a named filter rule in the configuration file.
+//
+// Without a list of sensors, the filter applies to the whole response.
+// Otherwise, only the sensors whose object IDs match one of the glob patterns are affected.
+type FilterDefinition struct {
+	FilterRule `yaml:",inline"`
+
+	Sensors []string `yaml:"sensors,omitempty"`
+}
+
+// builtinFilters are used if a filter is not defined in the configuration file.
+// They keep the filter names of former versions working with legacy sensor lists.
+var builtinFilters = map[string]string{
+	// The LG PCS manager occasionally reads from other addresses or receives
+	// truncated responses. The battery register is used as a sanity check.
+	"pcs": `
+address: 0x9c72
+count: { min: 92 }
+registers:
+- address: 0x9ca4
+  size: 2
+  value: { min: 1 }
+`,
+}
+
+func builtinFilter(name string) (*FilterDefinition, bool) {
+	def, ok := builtinFilters[name]
+	if !ok {
+		return nil, false
+	}
+
+	fd := &FilterDefinition{}
+	if err := yaml.Unmarshal([]byte(def), fd); err != nil {
+		panic(fmt.Sprintf("invalid builtin filter %s: %s", name, err))
+	}
+
+	return fd, true
+}
+
+func (fd *FilterDefinition) Global() bool {
+	return len(fd.Sensors) == 0
+}
+
+func (fd *FilterDefinition) Applies(s *Sensor) bool {
+	for _, pattern := range fd.Sensors {
+		if ok, _ := path.Match(pattern, s.ObjectID); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestValueMatch(t *testing.T) {
+	tests := []struct {
+		yaml  string
+		match []int64
+		miss  []int64
+	}{
+		{"5", []int64{5}, []int64{4, 6}},
+		{"0x9c72", []int64{0x9c72}, []int64{0x9c73}},
+		{"{min: 92}", []int64{92, 1000}, []int64{91, -1}},
+		{"{max: -1}", []int64{-1, -100}, []int64{0, 1}},
+		{"{min: 1, max: 3}", []int64{1, 2, 3}, []int64{0, 4}},
+		{"[1, {min: 10, max: 12}]", []int64{1, 10, 12}, []int64{2, 9, 13}},
+		{"[]", nil, []int64{0}},
+	}
+
+	for _, tt := range tests {
+		var vm ValueMatch
+		if err := yaml.Unmarshal([]byte(tt.yaml), &vm); err != nil {
+			t.Errorf("%s: failed to decode: %s", tt.yaml, err)
+			continue
+		}
+
+		for _, v := range tt.match {
+			if !vm.Match(v) {
+				t.Errorf("%s does not match %d", tt.yaml, v)
+			}
+		}
+
+		for _, v := range tt.miss {
+			if vm.Match(v) {
+				t.Errorf("%s matches %d", tt.yaml, v)
+			}
+		}
+	}
+
+	for _, s := range []string{"abc", "{min: x}", "[[a]]"} {
+		var vm ValueMatch
+		if err := yaml.Unmarshal([]byte(s), &vm); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestRegisterMatch(t *testing.T) {
+	req := &ReadHoldingRegistersRequest{Address: 0x100}
+	resp := &ReadHoldingRegistersResponse{
+		Registers: []uint16{0x0001, 0xffff, 0xfffe, 0x0000, 0x0001},
+	}
+
+	v := func(n int64) ValueMatch {
+		return ValueMatch{{Min: &n, Max: &n}}
+	}
+
+	tests := []struct {
+		rm   RegisterMatch
+		want bool
+	}{
+		{RegisterMatch{Address: 0x100, Value: v(1)}, true},
+		{RegisterMatch{Address: 0x101, Value: v(-1)}, true},
+		{RegisterMatch{Address: 0x101, Size: 1, Value: v(0xffff)}, false},
+		{RegisterMatch{Address: 0x102, Size: 2, Value: v(-131072)}, true},
+		{RegisterMatch{Address: 0x103, Size: 2, Value: v(1)}, true},
+		{RegisterMatch{Address: 0x104, Size: 2, Value: v(1)}, false}, // Beyond the response
+		{RegisterMatch{Address: 0x0ff, Value: v(0)}, false},          // Before the response
+		{RegisterMatch{Address: 0x100, Size: 3, Value: v(1)}, false},
+	}
+
+	for i, tt := range tests {
+		if got := tt.rm.Match(req, resp); got != tt.want {
+			t.Errorf("%d: match = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestFilterRule(t *testing.T) {
+	msg := &Message{Pid: 100, Fd: 5}
+	req := &ReadHoldingRegistersRequest{Unit: 1, FunctionCode: 3, Address: 0x9c72}
+	resp := &ReadHoldingRegistersResponse{Unit: 1, FunctionCode: 3, Registers: make([]uint16, 92)}
+	resp.Registers[0x9ca4-0x9c72+1] = 7
+
+	tests := []struct {
+		yaml string
+		want bool
+	}{
+		{"{}", true},
+		{"unit: 1", true},
+		{"unit: 2", false},
+		{"function_code: 3", true},
+		{"address: 0x9c72\ncount: {min: 92}", true},
+		{"address: 0x9c72\ncount: {min: 93}", false},
+		{"pid: 100\nfd: [3, 5]", true},
+		{"fd: 4", false},
+		{"registers: [{address: 0x9ca4, size: 2, value: {min: 1}}]", true},
+		{"registers: [{address: 0x9ca4, size: 2, value: {min: 8}}]", false},
+		{"not: {unit: 1}", false},
+		{"not: {unit: 2}", true},
+		{"any: [{unit: 2}, {fd: 5}]", true},
+		{"any: [{unit: 2}, {fd: 6}]", false},
+		{"all: [{unit: 1}, {fd: 5}]", true},
+		{"all: [{unit: 1}, {fd: 6}]", false},
+		{"unit: 1\nnot: {any: [{pid: 1}, {pid: 2}]}", true},
+	}
+
+	for _, tt := range tests {
+		var r FilterRule
+		if err := yaml.Unmarshal([]byte(tt.yaml), &r); err != nil {
+			t.Errorf("%q: failed to decode: %s", tt.yaml, err)
+			continue
+		}
+
+		if got := r.Filter(msg, req, resp); got != tt.want {
+			t.Errorf("%q: filter = %v, want %v", tt.yaml, got, tt.want)
+		}
+	}
+
+	// All filters must accept
+	accept := &FilterRule{}
+	reject := &FilterRule{Unit: ValueMatch{}}
+
+	if !(Filters{accept, accept}).Filter(msg, req, resp) {
+		t.Error("filters rejected response")
+	}
+
+	if (Filters{accept, reject}).Filter(msg, req, resp) {
+		t.Error("filters accepted response")
+	}
+}
+
+func TestFilterDefinitionApplies(t *testing.T) {
+	fd := FilterDefinition{
+		Sensors: []string{"pv_*", "battery_soc"},
+	}
+
+	for id, want := range map[string]bool{
+		"pv_power":     true,
+		"battery_soc":  true,
+		"battery_soh":  false,
+		"grid_pv_feed": false,
+	} {
+		if got := fd.Applies(&Sensor{ObjectID: id}); got != want {
+			t.Errorf("%s: applies = %v, want %v", id, got, want)
+		}
+	}
+
+	if fd.Global() {
+		t.Error("filter with sensors is global")
+	}
+}
+
+func TestConfigFilterBuiltin(t *testing.T) {
+	cfg := &Config{
+		Sensors: []Sensor{{ObjectID: "a"}},
+	}
+
+	f, _, err := cfg.Filter([]string{"pcs"})
+	if err != nil {
+		t.Fatalf("failed to setup builtin filter: %s", err)
+	}
+
+	regs := make([]uint16, 92)
+	regs[50], regs[51] = 0, 1
+
+	tests := []struct {
+		addr uint16
+		regs []uint16
+		want bool
+	}{
+		{0x9c72, regs, true},
+		{0x9c73, regs, false},
+		{0x9c72, regs[:91], false},
+		{0x9c72, make([]uint16, 92), false},
+	}
+
+	for _, tt := range tests {
+		req := &ReadHoldingRegistersRequest{Address: tt.addr}
+		resp := &ReadHoldingRegistersResponse{Registers: tt.regs}
+
+		if got := f.Filter(&Message{}, req, resp); got != tt.want {
+			t.Errorf("address %#x with %d registers: got %v, want %v", tt.addr, len(tt.regs), got, tt.want)
+		}
+	}
+
+	if _, _, err := cfg.Filter([]string{"unknown"}); err == nil {
+		t.Error("expected error for unknown filter")
+	}
+}
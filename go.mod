@@ -9,13 +9,14 @@ toolchain go1.25.2
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/howeyc/crc16 v0.0.0-20171223171357-2b2a61e366a6
+	golang.org/x/crypto v0.42.0
 	golang.org/x/exp v0.0.0-20251009144603-d2f985daa21b
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/net v0.44.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
 )
@@ -5,8 +5,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"golang.org/x/exp/slog"
@@ -14,7 +17,15 @@ import (
 )
 
 const (
-	ComponentSensor = "sensor"
+	ComponentSensor       = "sensor"
+	ComponentBinarySensor = "binary_sensor"
+
+	EntityCategoryConfig     = "config"
+	EntityCategoryDiagnostic = "diagnostic"
+
+	// Default payloads of binary sensors
+	PayloadOn  = "ON"
+	PayloadOff = "OFF"
 
 	// https://www.home-assistant.io/docs/configuration/customizing-devices/#device-class
 	DeviceClassBattery     = "battery"      // Percentage of battery that is left.
@@ -25,6 +36,11 @@ const (
 	DeviceClassTemperature = "temperature"  // Temperature in °C or °F.
 	DeviceClassVoltage     = "voltage"      // Voltage in V.
 	DeviceClassFrequency   = "frequency"    // Frequency in Hz, kHz, MHz or GHz.
+	DeviceClassEnum        = "enum"         // Limited set of non-numeric states.
+
+	// https://www.home-assistant.io/integrations/binary_sensor/#device-class
+	DeviceClassProblem = "problem" // On means problem detected.
+	DeviceClassRunning = "running" // On means running.
 
 	// https://developers.home-assistant.io/docs/core/entity/sensor#available-state-classes
 	StateClassMeasurement     = "measurement"
@@ -32,6 +48,7 @@ const (
 	StateClassTotalIncreasing = "total_increasing"
 )
 
+// Device groups sensors in Home Assistant.
 type Device struct {
 	Name         string `json:"name,omitempty" yaml:"name,omitempty"`
 	Model        string `json:"model,omitempty" yaml:"model,omitempty"`
@@ -40,47 +57,176 @@ type Device struct {
 	ConfigurationURL string `json:"configuration_url,omitempty" yaml:"configuration_url,omitempty"`
 
 	SoftwareVersion string `json:"sw_version,omitempty" yaml:"sw_version,omitempty"`
+	HardwareVersion string `json:"hw_version,omitempty" yaml:"hw_version,omitempty"`
+	SerialNumber    string `json:"serial_number,omitempty" yaml:"serial_number,omitempty"`
 
-	// Identifiers  []string `json:"identifiers`
+	// Fields which are read from registers or device identification objects
+	Info map[string]*DeviceInfoSource `json:"-" yaml:"info,omitempty"`
+
+	Identifiers []string   `json:"identifiers,omitempty" yaml:"identifiers,omitempty"`
 	Connections [][]string `json:"connections,omitempty" yaml:"connections,omitempty"`
+
+	// Name of the parent device in the configuration file
+	ViaDevice string `json:"via_device,omitempty" yaml:"via_device,omitempty"`
+
+	// Overrides the node ID of the discovery topics of all sensors of the device
+	NodeID string `json:"-" yaml:"node_id,omitempty"`
+
+	key string  // Name in the configuration file
+	via *Device // Resolved parent device
+}
+
+// identifier returns the identifier which Home Assistant uses to reference the device.
+func (d *Device) identifier() string {
+	if len(d.Identifiers) > 0 {
+		return d.Identifiers[0]
+	}
+
+	if d.key != "" {
+		return fmt.Sprintf("%s_%s", hassioMQTTNodeID, d.key)
+	}
+
+	return hassioMQTTNodeID
+}
+
+// discovery returns the device as included in the discovery config.
+func (d *Device) discovery() *Device {
+	dc := *d
+
+	// Home Assistant merges entities into a single device by its identifiers
+	if len(dc.Identifiers) == 0 {
+		dc.Identifiers = []string{d.identifier()}
+	}
+
+	if d.via != nil {
+		dc.ViaDevice = d.via.identifier()
+	}
+
+	return &dc
 }
 
 type Sensor struct {
-	Quantity Quantity `json:"modbus" yaml:"modbus"`
-	Device   *Device  `json:"device,omitempty" yaml:"device,omitempty"`
+	Quantity    *Quantity    `json:"modbus,omitempty" yaml:"modbus,omitempty"`
+	Expression  string       `json:"-" yaml:"expression,omitempty"`
+	Integration *Integration `json:"-" yaml:"integration,omitempty"`
+	Meter       *Meter       `json:"-" yaml:"meter,omitempty"`
+	Aggregate   *Aggregate   `json:"-" yaml:"aggregate,omitempty"`
+	Limits      *Limits      `json:"-" yaml:"limits,omitempty"`
+	Publish     *Publish     `json:"-" yaml:"publish,omitempty"`
+	Device      *Device      `json:"device,omitempty" yaml:"-"`
+	DeviceName  string       `json:"-" yaml:"device,omitempty"` // Reference to a device in the configuration file
+
+	ObjectID          string  `json:"object_id,omitempty" yaml:"object_id,omitempty"`
+	UniqueID          string  `json:"unique_id,omitempty" yaml:"unique_id,omitempty"`
+	Name              string  `json:"name,omitempty" yaml:"name,omitempty"`
+	DeviceClass       string  `json:"device_class,omitempty" yaml:"device_class,omitempty"`
+	StateClass        string  `json:"state_class,omitempty" yaml:"state_class,omitempty"`
+	StateTopic        string  `json:"state_topic,omitempty" yaml:"state_topic,omitempty"`
+	AvailabilityTopic string  `json:"availability_topic,omitempty" yaml:"-"`
+	UnitOfMeasurement string  `json:"unit_of_measurement,omitempty" yaml:"unit_of_measurement,omitempty"`
+	Icon              string  `json:"icon,omitempty" yaml:"icon,omitempty"`
+	Component         string  `json:"component" yaml:"component"`
+	Options           Options `json:"options,omitempty" yaml:"options,omitempty"`
+	EntityCategory    string  `json:"entity_category,omitempty" yaml:"entity_category,omitempty"`
+
+	ExpireAfter               time.Duration `json:"-" yaml:"expire_after,omitempty"`
+	ExpireAfterSeconds        int           `json:"expire_after,omitempty" yaml:"-"`
+	SuggestedDisplayPrecision *int          `json:"suggested_display_precision,omitempty" yaml:"suggested_display_precision,omitempty"`
+	ForceUpdate               bool          `json:"force_update,omitempty" yaml:"force_update,omitempty"`
+	EnabledByDefault          *bool         `json:"enabled_by_default,omitempty" yaml:"enabled_by_default,omitempty"`
+
+	ValueTemplate          string `json:"value_template,omitempty" yaml:"value_template,omitempty"`
+	LastResetValueTemplate string `json:"last_reset_value_template,omitempty" yaml:"last_reset_value_template,omitempty"`
+
+	JSONAttributesTopic    string `json:"json_attributes_topic,omitempty" yaml:"json_attributes_topic,omitempty"`
+	JSONAttributesTemplate string `json:"json_attributes_template,omitempty" yaml:"json_attributes_template,omitempty"`
+}
 
-	ObjectID          string `json:"object_id,omitempty" yaml:"object_id,omitempty"`
-	UniqueID          string `json:"unique_id,omitempty" yaml:"unique_id,omitempty"`
-	Name              string `json:"name,omitempty" yaml:"name,omitempty"`
-	DeviceClass       string `json:"device_class,omitempty" yaml:"device_class,omitempty"`
-	StateClass        string `json:"state_class,omitempty" yaml:"state_class,omitempty"`
-	StateTopic        string `json:"state_topic,omitempty" yaml:"state_topic,omitempty"`
-	UnitOfMeasurement string `json:"unit_of_measurement,omitempty" yaml:"unit_of_measurement,omitempty"`
-	Icon              string `json:"icon,omitempty" yaml:"icon,omitempty"`
-	Component         string `json:"component" yaml:"component"`
+// Option is a possible state of an enum sensor.
+type Option struct {
+	Value int64
+	Label string
 }
 
-func ReadSensors(fn string) ([]Sensor, error) {
-	var sensors []Sensor
+// Options are the possible states of an enum sensor.
+//
+// In the configuration file, they are either given as a list of labels
+// which are indexed by the value, or as a mapping from values to labels.
+type Options []Option
+
+func (o *Options) UnmarshalYAML(n *yaml.Node) error {
+	*o = nil
+
+	switch n.Kind {
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			*o = append(*o, Option{
+				Value: int64(i),
+				Label: c.Value,
+			})
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			var v int64
+			if err := n.Content[i].Decode(&v); err != nil {
+				return fmt.Errorf("invalid option value: %w", err)
+			}
+
+			*o = append(*o, Option{
+				Value: v,
+				Label: n.Content[i+1].Value,
+			})
+		}
+
+	default:
+		return errors.New("options must be a list or a mapping")
+	}
 
-	f, err := os.Open(fn)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// MarshalJSON returns the list of labels as expected by Home Assistant.
+func (o Options) MarshalJSON() ([]byte, error) {
+	labels := []string{}
+	for _, opt := range o {
+		labels = append(labels, opt.Label)
 	}
-	defer f.Close()
 
-	if err := yaml.NewDecoder(f).Decode(&sensors); err != nil {
-		return nil, err
+	return json.Marshal(labels)
+}
+
+func (o Options) Label(v int64) (string, bool) {
+	for _, opt := range o {
+		if opt.Value == v {
+			return opt.Label, true
+		}
+	}
+
+	return "", false
+}
+
+func (o Options) Value(label string) (int64, bool) {
+	for _, opt := range o {
+		if opt.Label == label {
+			return opt.Value, true
+		}
 	}
 
-	return sensors, nil
+	return 0, false
 }
 
+// ReadDevice reads the legacy device definition file.
+// A missing file is not considered an error.
 func ReadDevice(fn string) (*Device, error) {
 	device := &Device{}
 
 	f, err := os.Open(fn)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
 		return nil, err
 	}
 	defer f.Close()
@@ -89,35 +235,337 @@ func ReadDevice(fn string) (*Device, error) {
 		return nil, err
 	}
 
+	if err := device.validateInfo(); err != nil {
+		return nil, err
+	}
+
 	return device, nil
 }
 
+func (s *Sensor) validate() error {
+	sources := 0
+
+	if s.Quantity != nil {
+		sources++
+	}
+
+	if s.Expression != "" {
+		sources++
+	}
+
+	if s.Integration != nil {
+		sources++
+
+		if s.Integration.Source == "" {
+			return errors.New("missing integration source")
+		}
+
+		if s.StateClass == "" {
+			s.StateClass = StateClassTotalIncreasing
+		}
+	}
+
+	if s.Meter != nil {
+		sources++
+
+		if s.Meter.Source == "" {
+			return errors.New("missing meter source")
+		}
+
+		switch s.Meter.Period {
+		case PeriodDaily, PeriodWeekly, PeriodMonthly, PeriodYearly:
+		default:
+			return fmt.Errorf("invalid meter period: %s", s.Meter.Period)
+		}
+
+		// Home Assistant requires a state class of total when a last reset is provided
+		if s.StateClass == "" {
+			s.StateClass = StateClassTotal
+		}
+
+		s.ValueTemplate = "{{ value_json.value }}"
+		s.LastResetValueTemplate = "{{ value_json.last_reset }}"
+	}
+
+	if a := s.Aggregate; a != nil {
+		sources++
+
+		if a.Source == "" {
+			return errors.New("missing aggregate source")
+		}
+
+		if a.Window <= 0 {
+			return errors.New("missing aggregate window")
+		}
+
+		switch a.Function {
+		case AggregateMean, AggregateTimeWeightedMean, AggregateMin, AggregateMax, AggregateLast, AggregateCount:
+		default:
+			return fmt.Errorf("invalid aggregate function: %s", a.Function)
+		}
+	}
+
+	if sources != 1 {
+		return errors.New("exactly one of modbus, expression, integration, meter or aggregate must be defined")
+	}
+
+	if err := s.validateDiscovery(); err != nil {
+		return err
+	}
+
+	if l := s.Limits; l != nil {
+		if l.Min != nil && l.Max != nil && *l.Min > *l.Max {
+			return errors.New("limits: min is larger than max")
+		}
+
+		if o := l.Outliers; o != nil && (o.Sigma <= 0 || o.Samples < 2) {
+			return errors.New("limits: outliers require a positive sigma and at least two samples")
+		}
+	}
+
+	if p := s.Publish; p != nil {
+		if p.MinInterval > 0 && p.MaxInterval > 0 && p.MinInterval > p.MaxInterval {
+			return errors.New("publish: min_interval is larger than max_interval")
+		}
+	}
+
+	return nil
+}
+
+// validateDiscovery checks the Home Assistant specific settings.
+func (s *Sensor) validateDiscovery() error {
+	if s.Component == "" {
+		s.Component = ComponentSensor
+	}
+
+	if len(s.Options) > 0 && s.DeviceClass == "" {
+		s.DeviceClass = DeviceClassEnum
+	}
+
+	switch s.Component {
+	case ComponentSensor:
+		if s.DeviceClass != "" && !sensorDeviceClasses[s.DeviceClass] {
+			return fmt.Errorf("invalid device class for sensor: %s", s.DeviceClass)
+		}
+
+		if s.DeviceClass == DeviceClassEnum {
+			if len(s.Options) == 0 {
+				return errors.New("enum sensors require options")
+			}
+
+			if s.StateClass != "" || s.UnitOfMeasurement != "" {
+				return errors.New("enum sensors must not have a state class or unit of measurement")
+			}
+		} else if len(s.Options) > 0 {
+			return errors.New("options are only supported for enum sensors")
+		}
+
+	case ComponentBinarySensor:
+		if s.DeviceClass != "" && !binarySensorDeviceClasses[s.DeviceClass] {
+			return fmt.Errorf("invalid device class for binary sensor: %s", s.DeviceClass)
+		}
+
+		if s.StateClass != "" || s.UnitOfMeasurement != "" || len(s.Options) > 0 || s.SuggestedDisplayPrecision != nil {
+			return errors.New("binary sensors do not support state classes, units of measurement, options or display precisions")
+		}
+
+	default:
+		return fmt.Errorf("unsupported component: %s", s.Component)
+	}
+
+	if s.StateClass != "" && !stateClasses[s.StateClass] {
+		return fmt.Errorf("invalid state class: %s", s.StateClass)
+	}
+
+	if s.EntityCategory != "" && !entityCategories[s.EntityCategory] {
+		return fmt.Errorf("invalid entity category: %s", s.EntityCategory)
+	}
+
+	if s.ExpireAfter < 0 {
+		return errors.New("expire_after must not be negative")
+	}
+
+	if p := s.SuggestedDisplayPrecision; p != nil && *p < 0 {
+		return errors.New("suggested_display_precision must not be negative")
+	}
+
+	return nil
+}
+
 func (s *Sensor) Topic(sub string) string {
-	return fmt.Sprintf("%s/%s/%s/%s/%s", hassioMQTTDiscoveryPrefix, s.Component, hassioMQTTNodeID, s.ObjectID, sub)
+	return fmt.Sprintf("%s/%s/%s/%s/%s", hassioMQTTDiscoveryPrefix, s.Component, s.nodeID(), s.ObjectID, sub)
 }
 
-func (s *Sensor) SendConfig(c mqtt.Client) error {
-	s.StateTopic = s.Topic("state")
+func (s *Sensor) nodeID() string {
+	if s.Device != nil && s.Device.NodeID != "" {
+		return s.Device.NodeID
+	}
+
+	return hassioMQTTNodeID
+}
+
+// clone returns a copy of the sensor and its device which is not changed by the main loop.
+func (s *Sensor) clone() *Sensor {
+	c := *s
+
+	if s.Device != nil {
+		d := *s.Device
+		c.Device = &d
+	}
+
+	return &c
+}
 
+func (s *Sensor) SendConfig(c mqtt.Client) error {
 	t := *s
+	t.StateTopic = s.Topic("state")
+	t.AvailabilityTopic = availabilityTopic()
+
 	if t.UniqueID == "" {
 		t.UniqueID = t.ObjectID
 	}
 
+	t.ExpireAfterSeconds = int(s.ExpireAfter.Seconds())
+
+	if t.Device != nil {
+		t.Device = t.Device.discovery()
+	}
+
+	// All sensors share the JSON object of the device
+	if mqttStateMode == StateModeDevice {
+		field := fmt.Sprintf("value_json['values']['%s']", s.ObjectID)
+
+		t.StateTopic = deviceStateTopic(s.Device)
+		t.ValueTemplate = fmt.Sprintf("{{ %s }}", field)
+
+		if s.Meter != nil {
+			t.ValueTemplate = fmt.Sprintf("{{ %s.value }}", field)
+			t.LastResetValueTemplate = fmt.Sprintf("{{ %s.last_reset }}", field)
+		}
+
+		attrs := "'time': value_json.time"
+		if s.Quantity != nil {
+			attrs += fmt.Sprintf(", 'registers': value_json['registers']['%s']", s.ObjectID)
+		}
+
+		if t.JSONAttributesTopic == "" {
+			t.JSONAttributesTopic = t.StateTopic
+			t.JSONAttributesTemplate = fmt.Sprintf("{{ { %s } | tojson }}", attrs)
+		}
+	}
+
 	payload, err := json.Marshal(&t)
 	if err != nil {
 		return err
 	}
 
-	c.Publish(s.Topic("config"), 2, false, payload)
+	c.Publish(s.Topic("config"), mqttQoS, mqttDiscoveryRetain, payload)
 
 	return nil
 }
 
-func (s *Sensor) SendState(c mqtt.Client, value float32) {
-	payload := fmt.Sprintf("%.2f", value)
+func (s *Sensor) SendState(c mqtt.Client, upd Update) {
+	c.Publish(s.Topic("state"), mqttQoS, mqttRetain, s.statePayload(upd))
+}
+
+// statePayload formats a value for the state topic.
+func (s *Sensor) statePayload(upd Update) string {
+	// Periodically resetting sensors carry the time of their last reset
+	if s.Meter != nil {
+		return fmt.Sprintf(`{"value":%.2f,"last_reset":"%s"}`, upd.Value, upd.LastReset.Format(time.RFC3339))
+	}
+
+	if s.Component == ComponentBinarySensor {
+		if upd.Value != 0 {
+			return PayloadOn
+		}
+
+		return PayloadOff
+	}
+
+	if s.DeviceClass == DeviceClassEnum {
+		v := int64(upd.Value)
+		if label, ok := s.Options.Label(v); ok {
+			return label
+		}
+
+		slog.Warn("Value has no option", slog.String("id", s.ObjectID), slog.Int64("value", v))
+
+		return strconv.FormatInt(v, 10)
+	}
+
+	return fmt.Sprintf("%.2f", upd.Value)
+}
+
+// stateJSON formats a value for a JSON object.
+func (s *Sensor) stateJSON(upd Update) json.RawMessage {
+	payload := s.statePayload(upd)
+
+	if s.Component == ComponentBinarySensor || s.DeviceClass == DeviceClassEnum {
+		b, _ := json.Marshal(payload)
+		return b
+	}
+
+	return json.RawMessage(payload)
+}
+
+// parseState is the inverse of statePayload and stateJSON.
+func (s *Sensor) parseState(payload []byte) (float32, error) {
+	str := string(payload)
+
+	if len(payload) > 0 && payload[0] == '"' {
+		if err := json.Unmarshal(payload, &str); err != nil {
+			return 0, err
+		}
+	}
+
+	if s.Component == ComponentBinarySensor {
+		switch str {
+		case PayloadOn:
+			return 1, nil
+		case PayloadOff:
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("invalid binary state: %s", str)
+	}
+
+	if s.DeviceClass == DeviceClassEnum {
+		if v, ok := s.Options.Value(str); ok {
+			return float32(v), nil
+		}
+	}
+
+	if s.Meter != nil {
+		var state struct {
+			Value json.Number `json:"value"`
+		}
+
+		if err := json.Unmarshal(payload, &state); err == nil {
+			str = state.Value.String()
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return float32(value), nil
+}
 
-	c.Publish(s.Topic("state"), 2, false, payload)
+// SubscribeState subscribes to the state topic of the sensor.
+// This allows to receive values which are published by another sniffer instance.
+func (s *Sensor) SubscribeState(c *MQTTClient, cb func(value float32)) error {
+	return c.AddSubscription(s.Topic("state"), 1, func(_ mqtt.Client, m mqtt.Message) {
+		value, err := s.parseState(m.Payload())
+		if err != nil {
+			slog.Warn("Received invalid state", slog.String("topic", m.Topic()), slog.Any("error", err))
+			return
+		}
+
+		cb(value)
+	})
 }
 
 func (s Sensor) LogValue() slog.Value {
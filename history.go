@@ -0,0 +1,732 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	historyTierRaw    = "raw"
+	historyRecordSize = 24
+	historyDateFormat = "2006-01-02"
+)
+
+// HistoryTier is a level of the history store.
+// The raw tier keeps every sample, others keep one record per step.
+type HistoryTier struct {
+	Name      string
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// ParseHistoryTiers parses a list of tiers like "raw=48h,1m=30d,15m=365d".
+func ParseHistoryTiers(s string) ([]HistoryTier, error) {
+	tiers := []HistoryTier{}
+
+	for _, part := range strings.Split(s, ",") {
+		name, retention, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier: %s", part)
+		}
+
+		t := HistoryTier{
+			Name: name,
+		}
+
+		if name != historyTierRaw {
+			step, err := time.ParseDuration(name)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step of tier: %s", name)
+			}
+
+			t.Step = step
+		}
+
+		r, err := parseDays(retention)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid retention of tier %s: %s", name, retention)
+		}
+
+		t.Retention = r
+		tiers = append(tiers, t)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].Step < tiers[j].Step
+	})
+
+	return tiers, nil
+}
+
+// parseDays parses a duration which may also be given in days.
+func parseDays(s string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(d)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+
+	return time.ParseDuration(s)
+}
+
+// HistoryRecord is a sample of the raw tier or a summary of a step.
+type HistoryRecord struct {
+	Time  time.Time `json:"time"`
+	Mean  float32   `json:"mean"`
+	Min   float32   `json:"min"`
+	Max   float32   `json:"max"`
+	Count uint32    `json:"count"`
+}
+
+func (r *HistoryRecord) add(o HistoryRecord) {
+	if r.Count == 0 {
+		r.Min, r.Max = o.Min, o.Max
+	} else {
+		r.Min = float32(math.Min(float64(r.Min), float64(o.Min)))
+		r.Max = float32(math.Max(float64(r.Max), float64(o.Max)))
+	}
+
+	r.Mean = (r.Mean*float32(r.Count) + o.Mean*float32(o.Count)) / float32(r.Count+o.Count)
+	r.Count += o.Count
+}
+
+func (r *HistoryRecord) marshal(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], uint64(r.Time.UnixMilli()))
+	binary.LittleEndian.PutUint32(b[8:], math.Float32bits(r.Mean))
+	binary.LittleEndian.PutUint32(b[12:], math.Float32bits(r.Min))
+	binary.LittleEndian.PutUint32(b[16:], math.Float32bits(r.Max))
+	binary.LittleEndian.PutUint32(b[20:], r.Count)
+}
+
+func (r *HistoryRecord) unmarshal(b []byte) {
+	r.Time = time.UnixMilli(int64(binary.LittleEndian.Uint64(b[0:])))
+	r.Mean = math.Float32frombits(binary.LittleEndian.Uint32(b[8:]))
+	r.Min = math.Float32frombits(binary.LittleEndian.Uint32(b[12:]))
+	r.Max = math.Float32frombits(binary.LittleEndian.Uint32(b[16:]))
+	r.Count = binary.LittleEndian.Uint32(b[20:])
+}
+
+type historySeries struct {
+	pending  []HistoryRecord // Not yet written to disk
+	flushing []HistoryRecord // Being written to disk by Flush
+	bucket   HistoryRecord   // Current step of downsampled tiers
+}
+
+// History is an on-disk store of past sensor values.
+//
+// Records are kept in one file per tier, sensor and day:
+//
+//	<dir>/<tier>/<object id>/<date>.bin
+//
+// New records are buffered in memory until the next flush. Files are
+// removed once all of their records have exceeded the retention of their
+// tier. The age is measured relative to the newest sample so that replays
+// of old captures are retained as well.
+//
+// The in-memory state is guarded by mutex, which is only held briefly so
+// that Add does not block the main loop. Records remain in memory until
+// their file has been written. A file and the records in memory which
+// belong to it are read together while holding files. As it is only held
+// for a single file, long queries do not block flushes.
+//
+// After a restart within a step, a downsampled tier holds two records of
+// the step. They are merged by queries.
+type History struct {
+	dir   string
+	tiers []HistoryTier
+
+	series  map[string]map[string]*historySeries // By tier and object ID
+	sensors map[string]*Sensor
+	latest  time.Time
+
+	mutex sync.Mutex
+	files sync.RWMutex
+}
+
+func NewHistory(dir string, tiers []HistoryTier, sensors []Sensor) (*History, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		dir:     dir,
+		tiers:   tiers,
+		series:  map[string]map[string]*historySeries{},
+		sensors: map[string]*Sensor{},
+	}
+
+	for _, t := range tiers {
+		h.series[t.Name] = map[string]*historySeries{}
+	}
+
+	for i := range sensors {
+		h.sensors[sensors[i].ObjectID] = &sensors[i]
+	}
+
+	return h, nil
+}
+
+func (h *History) get(tier, id string) *historySeries {
+	s, ok := h.series[tier][id]
+	if !ok {
+		s = &historySeries{}
+		h.series[tier][id] = s
+	}
+
+	return s
+}
+
+// Add stores a new sensor value.
+func (h *History) Add(upd Update) {
+	// Would spoil the downsampled records
+	if !isFinite(upd.Value) {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if upd.Time.After(h.latest) {
+		h.latest = upd.Time
+	}
+
+	rec := HistoryRecord{
+		Time:  upd.Time,
+		Mean:  upd.Value,
+		Min:   upd.Value,
+		Max:   upd.Value,
+		Count: 1,
+	}
+
+	for _, t := range h.tiers {
+		s := h.get(t.Name, upd.Sensor.ObjectID)
+
+		if t.Step == 0 {
+			s.pending = append(s.pending, rec)
+			continue
+		}
+
+		start := upd.Time.Truncate(t.Step)
+		if s.bucket.Count > 0 && start.After(s.bucket.Time) {
+			s.pending = append(s.pending, s.bucket)
+			s.bucket = HistoryRecord{}
+		}
+
+		if s.bucket.Count == 0 {
+			s.bucket.Time = start
+		}
+
+		s.bucket.add(rec)
+	}
+}
+
+// Flush writes the buffered records to disk and applies the retention.
+func (h *History) Flush() error {
+	// The records are moved aside so that Add can continue while we write
+	h.mutex.Lock()
+
+	flushing := map[string]map[string][]HistoryRecord{}
+	for tier, series := range h.series {
+		flushing[tier] = map[string][]HistoryRecord{}
+
+		for id, s := range series {
+			if len(s.pending) > 0 {
+				s.flushing = s.pending
+				s.pending = nil
+
+				flushing[tier][id] = s.flushing
+			}
+		}
+	}
+
+	latest := h.latest
+
+	h.mutex.Unlock()
+
+	var errs []error
+
+	for tier, series := range flushing {
+		for id, recs := range series {
+			if err := h.write(tier, id, recs); err != nil {
+				errs = append(errs, err)
+
+				// Retried with the next flush
+				h.mutex.Lock()
+				s := h.get(tier, id)
+				s.pending = append(s.flushing, s.pending...)
+				s.flushing = nil
+				h.mutex.Unlock()
+			}
+		}
+	}
+
+	for _, t := range h.tiers {
+		if err := h.expire(t, latest); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close writes the records of the current steps of downsampled tiers and all buffered records to disk.
+func (h *History) Close() error {
+	h.mutex.Lock()
+
+	for _, series := range h.series {
+		for _, s := range series {
+			if s.bucket.Count > 0 {
+				s.pending = append(s.pending, s.bucket)
+				s.bucket = HistoryRecord{}
+			}
+		}
+	}
+
+	h.mutex.Unlock()
+
+	return h.Flush()
+}
+
+func (h *History) path(tier, id string, day time.Time) string {
+	return filepath.Join(h.dir, tier, id, day.UTC().Format(historyDateFormat)+".bin")
+}
+
+// write appends the records to their files.
+// Consecutive records of the same file are written at once and then removed from the flushing records.
+func (h *History) write(tier, id string, recs []HistoryRecord) error {
+	for len(recs) > 0 {
+		fn := h.path(tier, id, recs[0].Time)
+
+		n := 1
+		for n < len(recs) && h.path(tier, id, recs[n].Time) == fn {
+			n++
+		}
+
+		h.files.Lock()
+
+		err := h.writeFile(fn, recs[:n])
+		if err == nil {
+			h.mutex.Lock()
+			s := h.get(tier, id)
+			s.flushing = s.flushing[n:]
+			h.mutex.Unlock()
+		}
+
+		h.files.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		recs = recs[n:]
+	}
+
+	return nil
+}
+
+func (h *History) writeFile(fn string, recs []HistoryRecord) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	b := make([]byte, historyRecordSize)
+
+	for _, rec := range recs {
+		rec.marshal(b)
+
+		if _, err := w.Write(b); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (h *History) expire(t HistoryTier, latest time.Time) error {
+	if latest.IsZero() {
+		return nil
+	}
+
+	// A file holds the records of a whole day
+	limit := latest.Add(-t.Retention).UTC().Truncate(24 * time.Hour)
+
+	files, err := filepath.Glob(filepath.Join(h.dir, t.Name, "*", "*.bin"))
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range files {
+		day, err := time.Parse(historyDateFormat, strings.TrimSuffix(filepath.Base(fn), ".bin"))
+		if err != nil {
+			continue
+		}
+
+		if day.Before(limit) {
+			slog.Debug("Removing expired history", slog.String("file", fn))
+
+			if err := os.Remove(fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sensor returns the configured sensor with the given object ID.
+func (h *History) Sensor(id string) (*Sensor, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.sensors[id]
+	return s, ok
+}
+
+// Query returns the records of a sensor between start and end.
+//
+// Without a step, the finest tier which still covers the start is used.
+// Otherwise, the coarsest tier whose step is not larger than the requested
+// one is used and the records are combined into one record per step.
+func (h *History) Query(id string, start, end time.Time, step time.Duration) ([]HistoryRecord, HistoryTier, error) {
+	h.mutex.Lock()
+	tier, ok := h.tier(start, step)
+	now := h.now()
+	h.mutex.Unlock()
+
+	if !ok {
+		return nil, tier, errors.New("no tier covers the requested step")
+	}
+
+	// There are no files beyond the longest retention and the newest record
+	first, last := start, end
+	if oldest := now.Add(-h.retention()); first.Before(oldest) {
+		first = oldest
+	}
+
+	if last.After(now) {
+		last = now
+	}
+
+	recs := []HistoryRecord{}
+
+	for day := first.UTC().Truncate(24 * time.Hour); !day.After(last); day = day.Add(24 * time.Hour) {
+		r, err := h.readDay(tier.Name, id, day, start, end)
+		if err != nil {
+			return nil, tier, err
+		}
+
+		recs = append(recs, r...)
+	}
+
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Time.Before(recs[j].Time)
+	})
+
+	if step <= 0 {
+		step = tier.Step
+	}
+
+	// Also merges the records of a step which has been interrupted by a restart
+	if step > 0 {
+		recs = resample(recs, step)
+	}
+
+	return recs, tier, nil
+}
+
+// readDay returns the records of a day which are on disk or still in memory.
+func (h *History) readDay(tier, id string, day, start, end time.Time) ([]HistoryRecord, error) {
+	// Prevents that records are written while we read the file
+	h.files.RLock()
+	defer h.files.RUnlock()
+
+	recs, err := h.read(h.path(tier, id, day), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[tier][id]
+	if !ok {
+		return recs, nil
+	}
+
+	mem := append(s.flushing[:len(s.flushing):len(s.flushing)], s.pending...)
+	if s.bucket.Count > 0 {
+		mem = append(mem, s.bucket)
+	}
+
+	for _, rec := range mem {
+		if rec.Time.UTC().Truncate(24*time.Hour).Equal(day) && !rec.Time.Before(start) && rec.Time.Before(end) {
+			recs = append(recs, rec)
+		}
+	}
+
+	return recs, nil
+}
+
+// now returns the time of the newest record, or the current time if there is none.
+func (h *History) now() time.Time {
+	if h.latest.IsZero() {
+		return time.Now()
+	}
+
+	return h.latest
+}
+
+// retention returns the longest retention of all tiers.
+func (h *History) retention() time.Duration {
+	var r time.Duration
+	for _, t := range h.tiers {
+		if t.Retention > r {
+			r = t.Retention
+		}
+	}
+
+	return r
+}
+
+func (h *History) tier(start time.Time, step time.Duration) (HistoryTier, bool) {
+	now := h.now()
+
+	for i := range h.tiers {
+		t := h.tiers[i]
+
+		// Without a step, the finest tier is preferred, otherwise the coarsest which is sufficient
+		if step > 0 {
+			t = h.tiers[len(h.tiers)-1-i]
+
+			if t.Step > step {
+				continue
+			}
+		}
+
+		if now.Sub(start) <= t.Retention {
+			return t, true
+		}
+	}
+
+	// Fall back to the tier with the longest retention
+	var best HistoryTier
+	found := false
+	for _, t := range h.tiers {
+		if (step <= 0 || t.Step <= step) && t.Retention > best.Retention {
+			best, found = t, true
+		}
+	}
+
+	return best, found
+}
+
+func (h *History) read(fn string, start, end time.Time) ([]HistoryRecord, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	recs := []HistoryRecord{}
+	r := bufio.NewReader(f)
+	b := make([]byte, historyRecordSize)
+
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			// A partially written record at the end is ignored
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		var rec HistoryRecord
+		rec.unmarshal(b)
+
+		if !rec.Time.Before(start) && rec.Time.Before(end) {
+			recs = append(recs, rec)
+		}
+	}
+
+	return recs, nil
+}
+
+// resample combines sorted records into one record per step.
+func resample(recs []HistoryRecord, step time.Duration) []HistoryRecord {
+	out := []HistoryRecord{}
+
+	for _, rec := range recs {
+		start := rec.Time.Truncate(step)
+
+		if n := len(out); n > 0 && out[n-1].Time.Equal(start) {
+			out[n-1].add(rec)
+			continue
+		}
+
+		rec.Time = start
+		out = append(out, rec)
+	}
+
+	return out
+}
+
+// History of the sensor values, nil if disabled
+var history *History
+
+type ResponseHistory struct {
+	Sensor  string          `json:"sensor"`
+	Unit    string          `json:"unit,omitempty"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Step    string          `json:"step,omitempty"`
+	Tier    string          `json:"tier"`
+	Records []HistoryRecord `json:"records"`
+}
+
+// parseHistoryTime parses an absolute time in RFC 3339 format or as Unix timestamp,
+// or a duration relative to now like "-6h".
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	if d, err := parseDays(strings.TrimPrefix(s, "-")); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+func httpHandleApiHistory(w http.ResponseWriter, req *http.Request) {
+	if history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	id := req.PathValue("sensor")
+	sensor, ok := history.Sensor(id)
+	if !ok {
+		http.Error(w, "unknown sensor", http.StatusNotFound)
+		return
+	}
+
+	q := req.URL.Query()
+	now := time.Now()
+
+	var err error
+	var step time.Duration
+
+	resp := ResponseHistory{
+		Sensor: id,
+		Unit:   sensor.UnitOfMeasurement,
+		Start:  now.Add(-24 * time.Hour),
+		End:    now,
+	}
+
+	if v := q.Get("start"); v != "" {
+		if resp.Start, err = parseHistoryTime(v, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := q.Get("end"); v != "" {
+		if resp.End, err = parseHistoryTime(v, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := q.Get("step"); v != "" {
+		if step, err = parseDays(v); err != nil || step < 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+
+		resp.Step = v
+	}
+
+	if !resp.Start.Before(resp.End) {
+		http.Error(w, "start must be before end", http.StatusBadRequest)
+		return
+	}
+
+	var tier HistoryTier
+	if resp.Records, tier, err = history.Query(id, resp.Start, resp.End, step); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp.Tier = tier.Name
+
+	switch format := q.Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			slog.Error("Failed to write response", slog.Any("error", err))
+		}
+
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "mean", "min", "max", "count"})
+
+		for _, rec := range resp.Records {
+			cw.Write([]string{
+				rec.Time.Format(time.RFC3339Nano),
+				strconv.FormatFloat(float64(rec.Mean), 'g', -1, 32),
+				strconv.FormatFloat(float64(rec.Min), 'g', -1, 32),
+				strconv.FormatFloat(float64(rec.Max), 'g', -1, 32),
+				strconv.FormatUint(uint64(rec.Count), 10),
+			})
+		}
+
+		if cw.Flush(); cw.Error() != nil {
+			slog.Error("Failed to write response", slog.Any("error", cw.Error()))
+		}
+
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format: %s", format), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	tiers, err := ParseHistoryTiers("raw=2d,1m=30d,15m=365d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensors := []Sensor{{ObjectID: "power"}}
+
+	h, err := NewHistory(t.TempDir(), tiers, sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2023, 6, 15, 23, 50, 0, 0, time.UTC)
+
+	// Spans midnight so that two files are written per tier
+	for i := 0; i < 20; i++ {
+		h.Add(Update{
+			Sensor: &sensors[0],
+			Value:  float32(i),
+			Time:   ts.Add(time.Duration(i) * time.Minute),
+		})
+
+		// Half of the records are flushed, the others remain pending
+		if i == 9 {
+			if err := h.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	end := ts.Add(time.Hour)
+
+	recs, tier, err := h.Query("power", ts, end, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tier.Name != historyTierRaw || len(recs) != 20 {
+		t.Fatalf("got %d records of tier %s, want 20 of raw", len(recs), tier.Name)
+	}
+
+	for i, rec := range recs {
+		if rec.Mean != float32(i) {
+			t.Fatalf("record %d has value %v", i, rec.Mean)
+		}
+	}
+
+	// Queries from the epoch are limited to the longest retention
+	if recs, _, err = h.Query("power", time.Unix(0, 0), end, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(recs) != 2 {
+		t.Errorf("got %d records of 10 minutes, want 2", len(recs))
+	}
+
+	// The last bucket of the minute tier is still open
+	if recs, tier, err = h.Query("power", ts, end, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if tier.Name != "1m" || len(recs) != 20 {
+		t.Errorf("got %d records of tier %s, want 20 of 1m", len(recs), tier.Name)
+	}
+}
+
+func TestHistoryConcurrentQuery(t *testing.T) {
+	tiers, err := ParseHistoryTiers("raw=2d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensors := []Sensor{{ObjectID: "power"}}
+
+	h, err := NewHistory(t.TempDir(), tiers, sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans two days so that a query reads several files
+	ts := time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC)
+	n := 2000
+	step := 2 * time.Minute
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < n; i++ {
+			h.Add(Update{
+				Sensor: &sensors[0],
+				Value:  1,
+				Time:   ts.Add(time.Duration(i) * step),
+			})
+
+			if i%100 == 0 {
+				if err := h.Flush(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	// Every record is either on disk or pending, but never both or neither
+	for last, finished := 0, false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		recs, _, err := h.Query("power", ts, ts.Add(time.Duration(n)*step), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, rec := range recs {
+			if want := ts.Add(time.Duration(i) * step); !rec.Time.Equal(want) {
+				t.Fatalf("record %d at %s, want %s", i, rec.Time, want)
+			}
+		}
+
+		if len(recs) < last {
+			t.Fatalf("query returned %d records after %d before", len(recs), last)
+		}
+
+		last = len(recs)
+
+		if finished && last != n {
+			t.Errorf("got %d records, want %d", last, n)
+		}
+	}
+}
+
+func TestHistoryRestart(t *testing.T) {
+	tiers, err := ParseHistoryTiers("1m=30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensors := []Sensor{{ObjectID: "power"}}
+	dir := t.TempDir()
+	ts := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	add := func(h *History, offset time.Duration, v float32) {
+		h.Add(Update{
+			Sensor: &sensors[0],
+			Value:  v,
+			Time:   ts.Add(offset),
+		})
+	}
+
+	h, err := NewHistory(dir, tiers, sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add(h, 10*time.Second, 1)
+	add(h, 20*time.Second, 3)
+
+	// Writes the open bucket
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted within the same step
+	if h, err = NewHistory(dir, tiers, sensors); err != nil {
+		t.Fatal(err)
+	}
+
+	add(h, 40*time.Second, 5)
+	add(h, 70*time.Second, 7) // Closes the bucket of the first step
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, _, err := h.Query("power", ts, ts.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []HistoryRecord{
+		{Time: ts, Mean: 3, Min: 1, Max: 5, Count: 3},
+		{Time: ts.Add(time.Minute), Mean: 7, Min: 7, Max: 7, Count: 1},
+	}
+
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(recs), len(want))
+	}
+
+	for i, rec := range recs {
+		if !rec.Time.Equal(want[i].Time) || rec.Mean != want[i].Mean || rec.Min != want[i].Min || rec.Max != want[i].Max || rec.Count != want[i].Count {
+			t.Errorf("record %d: got %+v, want %+v", i, rec, want[i])
+		}
+	}
+}
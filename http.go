@@ -4,41 +4,186 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"golang.org/x/exp/slog"
 )
 
-var (
-	lastReadHoldingRegistersResponse *ReadHoldingRegistersResponse
-	lastResponseResult               = map[string]ResponseStatusResult{}
-)
+// Time given to open requests when shutting down
+const httpShutdownTimeout = 5 * time.Second
+
+// HTTPOptions configures the built-in HTTP server.
+type HTTPOptions struct {
+	Addr string
 
-func httpStart(addr string) {
-	http.HandleFunc("/api/v1/status", httpHandleApiStatus)
-	http.HandleFunc("/api/v1/raw", httpHandleApiRaw)
+	// TLS is enabled if a certificate and key or SelfSigned are given
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool
 
-	http.ListenAndServe(addr, nil)
+	Auth  *Auth        // Nil if authentication is disabled
+	Allow []*net.IPNet // Empty if all clients are allowed
+}
+
+// HTTPServer is the built-in HTTP server.
+type HTTPServer struct {
+	server *http.Server
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// httpStart starts the HTTP server.
+// Errors which occur before the server accepts connections are returned.
+func httpStart(opts HTTPOptions) (*HTTPServer, error) {
+	mux := http.NewServeMux()
+
+	handle := func(pattern, role string, h http.HandlerFunc) {
+		mux.Handle(pattern, httpRequire(opts.Auth, role, h))
+	}
+
+	handle("GET /api/v1/status", RoleReadOnly, httpHandleApiStatus)
+	handle("GET /api/v1/raw", RoleReadOnly, httpHandleApiRaw)
+	handle("GET /api/v1/units/{unit}/registers", RoleReadOnly, httpHandleApiRegisters)
+	handle("GET /api/v1/ranges", RoleReadOnly, httpHandleApiRanges)
+	handle("GET /api/v1/history/{sensor}", RoleReadOnly, httpHandleApiHistory)
+	handle("GET /api/v1/stream", RoleReadOnly, httpHandleApiStream)
+	handle("GET /api/v1/overview", RoleReadOnly, httpHandleApiOverview)
+	handle("GET /", RoleReadOnly, httpHandleDashboard().ServeHTTP)
+	handle("GET /metrics", RoleReadOnly, httpHandleMetrics)
+
+	// Long-lived requests like streams are cancelled on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &HTTPServer{
+		server: &http.Server{
+			Handler:           httpAllow(opts.Allow, mux),
+			ReadHeaderTimeout: 10 * time.Second,
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		cancel()
+		return nil, errors.New("certificate and key must be provided together")
+	}
+
+	var cert *tls.Certificate
+	if opts.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+
+		cert = &c
+	} else if opts.SelfSigned {
+		c, err := loadSelfSignedCertificate()
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to load self-signed certificate: %w", err)
+		}
+
+		cert = &c
+	}
+
+	ln, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if cert != nil {
+		ln = tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	slog.Info("Started HTTP server",
+		slog.String("addr", ln.Addr().String()),
+		slog.Bool("tls", cert != nil),
+		slog.Bool("auth", opts.Auth != nil))
+
+	go func() {
+		defer close(s.done)
+
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", slog.Any("error", err))
+		}
+	}()
+
+	return s, nil
+}
+
+// Shutdown stops accepting new connections and waits for open requests to complete.
+func (s *HTTPServer) Shutdown() {
+	s.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shutdown HTTP server", slog.Any("error", err))
+	}
+
+	<-s.done
 }
 
 type ResponseStatus struct {
 	Results map[string]ResponseStatusResult `json:"results"`
-	Time    time.Time                       `json:"time"`
+	Time    time.Time                       `json:"time"` // Time of the newest value
 }
 
 type ResponseStatusResult struct {
 	Sensor
-	Value float32 `json:"value"`
+	Value   float32   `json:"value"`
+	Time    time.Time `json:"time"`
+	Updates uint64    `json:"updates"`
 }
 
+// httpHandleApiStatus returns the last values of all sensors.
+// Results are keyed by the register of Modbus sensors and the object ID of all others.
 func httpHandleApiStatus(w http.ResponseWriter, req *http.Request) {
+	snap := stateStore.Snapshot()
+
 	resp := ResponseStatus{
-		Time:    time.Now(),
-		Results: lastResponseResult,
+		Time:    snap.Time,
+		Results: map[string]ResponseStatusResult{},
 	}
 
+	for _, v := range snap.Values {
+		if !isFinite(v.Value) {
+			continue
+		}
+
+		sensor := v.Sensor
+
+		name := sensor.ObjectID
+		if sensor.Quantity != nil {
+			name = fmt.Sprintf("%#x", sensor.Quantity.Register)
+		}
+
+		resp.Results[name] = ResponseStatusResult{
+			Sensor:  *sensor,
+			Value:   v.Value,
+			Time:    v.Time,
+			Updates: v.Updates,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
 	if err := json.NewEncoder(w).Encode(&resp); err != nil {
 		slog.Error("Failed to write response", slog.Any("error", err))
 	}
@@ -48,25 +193,29 @@ type ResponseRaw struct {
 	Time         string   `json:"time"`
 	Unit         byte     `json:"unit"`
 	FunctionCode byte     `json:"function_code"`
+	Address      uint16   `json:"address"`
 	ByteCount    byte     `json:"count"`
 	Registers    []uint16 `json:"registers"`
 	Checksum     uint16   `json:"checksum"`
 }
 
+// httpHandleApiRaw returns the last accepted response.
 func httpHandleApiRaw(w http.ResponseWriter, req *http.Request) {
-	if lastReadHoldingRegistersResponse == nil {
+	t := registerImage.Last()
+	if t == nil {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("no data yet\n"))
 		return
 	}
 
 	resp := ResponseRaw{
-		Time:         time.Now().Format(time.RFC3339),
-		Unit:         lastReadHoldingRegistersResponse.ByteCount,
-		FunctionCode: lastReadHoldingRegistersResponse.FunctionCode,
-		ByteCount:    lastReadHoldingRegistersResponse.ByteCount,
-		Registers:    lastReadHoldingRegistersResponse.Registers,
-		Checksum:     lastReadHoldingRegistersResponse.Checksum,
+		Time:         t.Time.Format(time.RFC3339),
+		Unit:         t.response.Unit,
+		FunctionCode: t.response.FunctionCode,
+		Address:      t.Address,
+		ByteCount:    t.response.ByteCount,
+		Registers:    t.response.Registers,
+		Checksum:     t.response.Checksum,
 	}
 
 	if err := json.NewEncoder(w).Encode(&resp); err != nil {
@@ -0,0 +1,390 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Maximum size of a single UDP datagram
+const influxUDPPayloadSize = 1400
+
+var errInfluxPermanent = errors.New("permanent error")
+
+// InfluxOptions configures the InfluxDB output.
+type InfluxOptions struct {
+	URL string
+
+	// InfluxDB v1
+	Database string
+	Username string
+	Password string
+
+	// InfluxDB v2
+	Token  string
+	Org    string
+	Bucket string
+
+	Measurement   string
+	BatchSize     int
+	FlushInterval time.Duration
+	Retries       int
+	Gzip          bool
+
+	// Wait for buffer space instead of dropping points, e.g. when replaying captures
+	Block bool
+}
+
+// InfluxSink writes sensor values in the InfluxDB line protocol.
+//
+// Values are written by a separate goroutine so that slow or unreachable
+// servers do not block the decoding of captured messages.
+type InfluxSink struct {
+	opts InfluxOptions
+	url  *url.URL
+
+	client *http.Client
+	conn   net.Conn
+	file   *os.File
+
+	lines chan string
+	done  chan struct{}
+}
+
+func NewInfluxSink(opts InfluxOptions) (*InfluxSink, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1
+	}
+
+	if opts.FlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid flush interval: %s", opts.FlushInterval)
+	}
+
+	s := &InfluxSink{
+		opts:  opts,
+		url:   u,
+		lines: make(chan string, 10*opts.BatchSize),
+		done:  make(chan struct{}),
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if opts.Token == "" && opts.Database == "" {
+			return nil, errors.New("either a database (v1) or a token (v2) is required")
+		}
+
+		if opts.Token != "" && (opts.Org == "" || opts.Bucket == "") {
+			return nil, errors.New("InfluxDB v2 requires an organization and a bucket")
+		}
+
+		s.client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
+
+	case "udp":
+		if s.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+
+	case "file":
+		if s.file, err = os.OpenFile(u.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Write queues a sensor value.
+func (s *InfluxSink) Write(upd Update) {
+	// The line protocol does not support these
+	if !isFinite(upd.Value) {
+		return
+	}
+
+	line := s.line(upd)
+
+	if s.opts.Block {
+		s.lines <- line
+		return
+	}
+
+	select {
+	case s.lines <- line:
+	default:
+		slog.Warn("Dropped InfluxDB point as the buffer is full", slog.String("id", upd.Sensor.ObjectID))
+	}
+}
+
+// Close writes all queued points and releases the connection.
+func (s *InfluxSink) Close() {
+	close(s.lines)
+	<-s.done
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func (s *InfluxSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := []string{}
+
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+
+			batch = append(batch, line)
+
+			if len(batch) >= s.opts.BatchSize {
+				s.flush(batch)
+				batch = []string{}
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.flush(batch)
+				batch = []string{}
+			}
+		}
+	}
+}
+
+func (s *InfluxSink) flush(batch []string) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = s.write(batch); err == nil {
+			return
+		}
+
+		if errors.Is(err, errInfluxPermanent) || attempt >= s.opts.Retries {
+			break
+		}
+
+		slog.Warn("Failed to write to InfluxDB, retrying", slog.Any("error", err), slog.Duration("backoff", backoff))
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	slog.Error("Failed to write to InfluxDB", slog.Int("points", len(batch)), slog.Any("error", err))
+}
+
+func (s *InfluxSink) write(batch []string) error {
+	switch {
+	case s.client != nil:
+		return s.writeHTTP(batch)
+
+	case s.conn != nil:
+		return s.writeUDP(batch)
+
+	default:
+		_, err := io.WriteString(s.file, strings.Join(batch, "\n")+"\n")
+		return err
+	}
+}
+
+func (s *InfluxSink) writeHTTP(batch []string) error {
+	u := *s.url
+	q := u.Query()
+
+	if s.opts.Token != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", s.opts.Org)
+		q.Set("bucket", s.opts.Bucket)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", s.opts.Database)
+	}
+
+	q.Set("precision", "ns")
+	u.RawQuery = q.Encode()
+
+	var body bytes.Buffer
+	payload := strings.Join(batch, "\n") + "\n"
+
+	if s.opts.Gzip {
+		zw := gzip.NewWriter(&body)
+		if _, err := io.WriteString(zw, payload); err != nil {
+			return err
+		}
+
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		body.WriteString(payload)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if s.opts.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if s.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.opts.Token)
+	} else if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+
+	// Client errors will not succeed on retry, except for rate limiting
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", errInfluxPermanent, err)
+	}
+
+	return err
+}
+
+// writeUDP sends the lines in as few datagrams as possible.
+func (s *InfluxSink) writeUDP(batch []string) error {
+	var buf bytes.Buffer
+
+	for _, line := range batch {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > influxUDPPayloadSize {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+
+			buf.Reset()
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	if buf.Len() > 0 {
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// line formats a sensor value as a point.
+//
+// The measurement defaults to the device class of the sensor.
+// The sensor definition is added as tags, sorted by key as recommended by InfluxDB.
+func (s *InfluxSink) line(upd Update) string {
+	sensor := upd.Sensor
+
+	measurement := s.opts.Measurement
+	if measurement == "" {
+		measurement = sensor.DeviceClass
+	}
+	if measurement == "" {
+		measurement = sensor.Component
+	}
+
+	var b strings.Builder
+
+	b.WriteString(influxEscape(measurement, `\, `))
+
+	tags := [][2]string{
+		{"object_id", sensor.ObjectID},
+		{"name", sensor.Name},
+		{"unit", sensor.UnitOfMeasurement},
+		{"state_class", sensor.StateClass},
+	}
+
+	if sensor.Device != nil {
+		tags = append(tags, [2]string{"device", sensor.Device.Name})
+	}
+
+	if sensor.Quantity != nil {
+		tags = append(tags, [2]string{"register", fmt.Sprintf("%#x", sensor.Quantity.Register)})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i][0] < tags[j][0]
+	})
+
+	for _, tag := range tags {
+		// Empty tag values are not allowed
+		if tag[1] == "" {
+			continue
+		}
+
+		fmt.Fprintf(&b, ",%s=%s", tag[0], influxEscape(tag[1], `\,= `))
+	}
+
+	fmt.Fprintf(&b, " value=%s %d", strconv.FormatFloat(float64(upd.Value), 'g', -1, 32), upd.Time.UnixNano())
+
+	return b.String()
+}
+
+func influxEscape(s, chars string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
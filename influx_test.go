@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	ts := time.Unix(1686830400, 123)
+
+	tests := []struct {
+		name        string
+		measurement string
+		sensor      Sensor
+		value       float32
+		want        string
+	}{
+		{"sorted tags", "", Sensor{
+			ObjectID:          "pv_power",
+			Name:              "PV power",
+			DeviceClass:       "power",
+			StateClass:        "measurement",
+			UnitOfMeasurement: "W",
+			Device:            &Device{Name: "ESS"},
+			Quantity:          &Quantity{Register: 0x9c72},
+		}, 1500.5, `power,device=ESS,name=PV\ power,object_id=pv_power,register=0x9c72,state_class=measurement,unit=W value=1500.5 1686830400000000123`},
+
+		{"component as measurement", "", Sensor{
+			ObjectID:  "charging",
+			Component: ComponentBinarySensor,
+		}, 1, `binary_sensor,object_id=charging value=1 1686830400000000123`},
+
+		{"configured measurement", "ess", Sensor{
+			ObjectID:    "a",
+			DeviceClass: "power",
+		}, -0.25, `ess,object_id=a value=-0.25 1686830400000000123`},
+
+		{"escaping", `my measurement,1\`, Sensor{
+			ObjectID: "a",
+			Name:     `a=b, c\`,
+			Device:   &Device{Name: `C:\ESS\`},
+		}, 1e10, `my\ measurement\,1\\,device=C:\\ESS\\,name=a\=b\,\ c\\,object_id=a value=1e+10 1686830400000000123`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &InfluxSink{
+				opts: InfluxOptions{
+					Measurement: tt.measurement,
+				},
+			}
+
+			if got := s.line(Update{Sensor: &tt.sensor, Value: tt.value, Time: ts}); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "points.txt")
+
+	s, err := NewInfluxSink(InfluxOptions{
+		URL:           "file://" + fn,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Block:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sensor := &Sensor{ObjectID: "a", DeviceClass: "power"}
+
+	for _, v := range []float32{1, float32(math.NaN()), float32(math.Inf(1)), 2, 3} {
+		s.Write(Update{Sensor: sensor, Value: v, Time: time.Unix(0, 0)})
+	}
+
+	// Remaining points are written on close
+	s.Close()
+
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "power,object_id=a value=1 0\npower,object_id=a value=2 0\npower,object_id=a value=3 0\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestInfluxHTTP(t *testing.T) {
+	type request struct {
+		path, query, auth, body string
+	}
+
+	tests := []struct {
+		name   string
+		opts   InfluxOptions
+		status int
+		want   request
+		writes int // Number of requests including retries
+	}{
+		{"v1", InfluxOptions{
+			Database: "ess",
+			Username: "user",
+			Password: "pass",
+		}, http.StatusNoContent, request{"/write", "db=ess&precision=ns", "Basic dXNlcjpwYXNz", "power,object_id=a value=1 0\n"}, 1},
+
+		{"v2 gzip", InfluxOptions{
+			Token:  "token",
+			Org:    "home",
+			Bucket: "ess",
+			Gzip:   true,
+		}, http.StatusNoContent, request{"/api/v2/write", "bucket=ess&org=home&precision=ns", "Token token", "power,object_id=a value=1 0\n"}, 1},
+
+		{"retry server errors", InfluxOptions{
+			Database: "ess",
+			Retries:  1,
+		}, http.StatusServiceUnavailable, request{"/write", "db=ess&precision=ns", "", "power,object_id=a value=1 0\n"}, 2},
+
+		{"no retry on client errors", InfluxOptions{
+			Database: "ess",
+			Retries:  1,
+		}, http.StatusBadRequest, request{"/write", "db=ess&precision=ns", "", "power,object_id=a value=1 0\n"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				reqs  []request
+				mutex sync.Mutex
+			)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body io.Reader = r.Body
+				if r.Header.Get("Content-Encoding") == "gzip" {
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					body = zr
+				}
+
+				b, _ := io.ReadAll(body)
+
+				mutex.Lock()
+				reqs = append(reqs, request{r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), string(b)})
+				mutex.Unlock()
+
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			opts := tt.opts
+			opts.URL = srv.URL
+			opts.FlushInterval = time.Hour
+
+			s, err := NewInfluxSink(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.Write(Update{Sensor: &Sensor{ObjectID: "a", DeviceClass: "power"}, Value: 1, Time: time.Unix(0, 0)})
+			s.Close()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if len(reqs) != tt.writes {
+				t.Fatalf("got %d requests, want %d", len(reqs), tt.writes)
+			}
+
+			if reqs[0] != tt.want {
+				t.Errorf("got %+v, want %+v", reqs[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts InfluxOptions
+		err  string
+	}{
+		{"flush interval", InfluxOptions{URL: "file:///dev/null"}, "invalid flush interval"},
+		{"scheme", InfluxOptions{URL: "tcp://localhost", FlushInterval: time.Second}, "unsupported URL scheme"},
+		{"database or token", InfluxOptions{URL: "http://localhost", FlushInterval: time.Second}, "either a database"},
+		{"v2", InfluxOptions{URL: "http://localhost", Token: "t", FlushInterval: time.Second}, "requires an organization"},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewInfluxSink(tt.opts); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	DefaultIntegrationMaxGap = 5 * time.Minute
+	DefaultIntegrationScale  = 1e-3 // W -> kWh
+)
+
+// Integration integrates a power sensor over time into an energy total.
+type Integration struct {
+	Source string        `json:"source" yaml:"source"`
+	MaxGap time.Duration `json:"max_gap,omitempty" yaml:"max_gap,omitempty"`
+	Scale  float64       `json:"scale,omitempty" yaml:"scale,omitempty"`
+}
+
+// IntegrationState is the persisted state of an integrator.
+type IntegrationState struct {
+	Total     float64   `json:"total"`
+	LastValue float64   `json:"last_value"`
+	LastTime  time.Time `json:"last_time"`
+}
+
+// integrator accumulates the area below the source values using the trapezoidal rule.
+//
+// Gaps between samples which exceed MaxGap are not bridged.
+// Negative areas are ignored so that the total is monotonically increasing.
+type integrator struct {
+	*Integration
+	IntegrationState
+}
+
+func newIntegrator(cfg *Integration) *integrator {
+	if cfg.MaxGap == 0 {
+		cfg.MaxGap = DefaultIntegrationMaxGap
+	}
+
+	if cfg.Scale == 0 {
+		cfg.Scale = DefaultIntegrationScale
+	}
+
+	return &integrator{
+		Integration: cfg,
+	}
+}
+
+func (i *integrator) Inputs() ([]string, []uint16) {
+	return []string{i.Source}, nil
+}
+
+func (i *integrator) Evaluate(env Env, ts time.Time) (float64, error) {
+	v, ok := env.Value(i.Source)
+	if !ok {
+		return 0, ErrUnknownValue
+	}
+
+	if !i.LastTime.IsZero() {
+		if dt := ts.Sub(i.LastTime); dt > 0 && dt <= i.MaxGap {
+			if area := (i.LastValue + v) / 2 * dt.Hours() * i.Scale; area > 0 {
+				i.Total += area
+			}
+		}
+	}
+
+	if ts.After(i.LastTime) {
+		i.LastValue = v
+		i.LastTime = ts
+	}
+
+	return i.Total, nil
+}
+
+func (i *integrator) State() any {
+	return &i.IntegrationState
+}
@@ -5,11 +5,17 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"golang.org/x/exp/slog"
@@ -18,6 +24,7 @@ import (
 var (
 	ErrNotEnoughData      = fmt.Errorf("not enough data")
 	ErrNotEnoughRegisters = fmt.Errorf("not enough registers")
+	ErrInvalidChecksum    = fmt.Errorf("invalid checksum")
 )
 
 var (
@@ -26,14 +33,42 @@ var (
 	filterMode                                string
 	fromFile, toFile, sensorsFile, deviceFile string
 
-	mqttDiscovery bool
-	mqttBroker    string
-	mqttOpts      *mqtt.ClientOptions = mqtt.NewClientOptions()
+	mqttDiscovery       bool
+	mqttDiscoveryRetain bool
+	mqttDiscoveryClean  bool
+	mqttDiscoveryScan   bool
+	mqttDiscoveryDryRun bool
+	mqttRetain          bool
+	mqttQoS             byte
+	mqttBroker          string
+	mqttQueueSize       int
+	mqttQueuePolicy     string
+	mqttStateMode       string
+	mqttUsernameFile    string
+	mqttPasswordFile    string
+	mqttTLS             TLSOptions
+	mqttOpts            *mqtt.ClientOptions = mqtt.NewClientOptions()
 
 	hassioMQTTDiscoveryPrefix string
 	hassioMQTTNodeID          string
 
-	httpListenAddr string
+	httpOpts         HTTPOptions
+	httpAuthFile     string
+	httpAllowedHosts string
+
+	influxOpts InfluxOptions
+
+	historyEnabled bool
+	historyTiers   []HistoryTier
+
+	stateDir      string
+	stateInterval time.Duration
+	timezone      string
+
+	publishBudget float64
+	publishBurst  int
+
+	availabilityTimeout time.Duration
 
 	deviceInfo *Device
 )
@@ -63,24 +98,140 @@ func parseFlags() (err error) {
 	flag.StringVar(&deviceFile, "device", "device.yaml", "Device definition file")
 
 	flag.StringVar(&mqttOpts.ClientID, "mqtt-client-id", "modbus-sniffer", "MQTT client ID")
-	flag.StringVar(&mqttOpts.Username, "mqtt-username", "", "MQTT username")
-	flag.StringVar(&mqttOpts.Password, "mqtt-password", "", "MQTT password")
-	flag.StringVar(&mqttBroker, "mqtt-broker", "", "MQTT broker url")
+	flag.StringVar(&mqttOpts.Username, "mqtt-username", "", "MQTT username (default $MQTT_USERNAME)")
+	flag.StringVar(&mqttOpts.Password, "mqtt-password", "", "MQTT password (default $MQTT_PASSWORD)")
+	flag.StringVar(&mqttUsernameFile, "mqtt-username-file", "", "File containing the MQTT username")
+	flag.StringVar(&mqttPasswordFile, "mqtt-password-file", "", "File containing the MQTT password")
+	flag.StringVar(&mqttBroker, "mqtt-broker", "", "MQTT broker url (use ssl://host:8883 for TLS)")
+	flag.StringVar(&mqttTLS.CAFile, "mqtt-ca", "", "CA certificate bundle for verifying the MQTT broker")
+	flag.StringVar(&mqttTLS.CertFile, "mqtt-cert", "", "Client certificate for authenticating at the MQTT broker")
+	flag.StringVar(&mqttTLS.KeyFile, "mqtt-key", "", "Private key of the client certificate")
+	flag.StringVar(&mqttTLS.ServerName, "mqtt-server-name", "", "Override the server name used for verifying the MQTT broker certificate")
+	flag.BoolVar(&mqttTLS.Insecure, "mqtt-insecure", false, "Skip verification of the MQTT broker certificate")
 	flag.BoolVar(&mqttDiscovery, "mqtt-discovery", true, "Send discovery messages to MQTT")
+	flag.BoolVar(&mqttDiscoveryRetain, "mqtt-discovery-retain", true, "Retain discovery messages")
+	flag.BoolVar(&mqttDiscoveryClean, "mqtt-discovery-cleanup", true, "Remove entities of sensors which are no longer configured")
+	flag.BoolVar(&mqttDiscoveryScan, "mqtt-discovery-scan", false, "Scan retained discovery messages for stale entities in addition to those published before")
+	flag.BoolVar(&mqttDiscoveryDryRun, "mqtt-discovery-cleanup-dry-run", false, "Only list stale entities instead of removing them")
+	flag.BoolVar(&mqttRetain, "mqtt-retain", false, "Retain state messages")
+	flag.StringVar(&mqttStateMode, "mqtt-state-mode", StateModeSensor, "Publish states to one topic per sensor (sensor) or as a single JSON object per device (device)")
+	qos := flag.Uint("mqtt-qos", 2, "MQTT QoS level for discovery and state messages")
+	flag.IntVar(&mqttQueueSize, "mqtt-queue-size", 10000, "Maximum number of messages queued on disk while the MQTT broker is unreachable (0 to disable)")
+	flag.StringVar(&mqttQueuePolicy, "mqtt-queue-policy", QueuePolicyLatest, "Policy for the MQTT queue: all, latest (per topic) or drop-oldest")
+	flag.DurationVar(&availabilityTimeout, "availability-timeout", time.Minute, "Mark sensors as unavailable if no valid frame has been received within this time (0 to disable)")
 
 	flag.StringVar(&hassioMQTTDiscoveryPrefix, "hassio-mqtt-discovery-prefix", "homeassistant", "MQTT Discovery Prefix")
 	flag.StringVar(&hassioMQTTNodeID, "hassio-mqtt-node-id", "modbus-sniffer", "MQTT Node ID")
 
-	flag.StringVar(&httpListenAddr, "http", "", "Listen address for built-in HTTP server")
-	flag.StringVar(&filterMode, "filter", "", "Set to 'pcs' to enable PCS filter")
+	flag.StringVar(&httpOpts.Addr, "http", "", "Listen address for built-in HTTP server")
+	flag.StringVar(&httpOpts.CertFile, "http-cert", "", "Certificate for serving HTTPS")
+	flag.StringVar(&httpOpts.KeyFile, "http-key", "", "Private key of the HTTPS certificate")
+	flag.BoolVar(&httpOpts.SelfSigned, "http-self-signed", false, "Serve HTTPS with a self-signed certificate which is generated on first start")
+	flag.StringVar(&httpAuthFile, "http-auth-file", "", "File containing users and tokens for authenticating HTTP clients")
+	flag.StringVar(&httpAllowedHosts, "http-allow", "", "Comma-separated list of addresses and networks which may access the HTTP server")
+
+	flag.StringVar(&influxOpts.URL, "influx-url", "", "InfluxDB url (http(s)://host:8086, udp://host:8089 or file:///path)")
+	flag.StringVar(&influxOpts.Database, "influx-database", "", "InfluxDB v1 database")
+	flag.StringVar(&influxOpts.Username, "influx-username", "", "InfluxDB v1 username")
+	flag.StringVar(&influxOpts.Password, "influx-password", "", "InfluxDB v1 password (default $INFLUX_PASSWORD)")
+	flag.StringVar(&influxOpts.Token, "influx-token", "", "InfluxDB v2 token (default $INFLUX_TOKEN)")
+	flag.StringVar(&influxOpts.Org, "influx-org", "", "InfluxDB v2 organization")
+	flag.StringVar(&influxOpts.Bucket, "influx-bucket", "", "InfluxDB v2 bucket")
+	flag.StringVar(&influxOpts.Measurement, "influx-measurement", "", "InfluxDB measurement (default device class of the sensor)")
+	flag.IntVar(&influxOpts.BatchSize, "influx-batch-size", 1000, "Maximum number of points written at once")
+	flag.DurationVar(&influxOpts.FlushInterval, "influx-flush-interval", 10*time.Second, "Maximum time points are buffered before being written")
+	flag.IntVar(&influxOpts.Retries, "influx-retries", 3, "Number of retries for failed writes")
+	flag.BoolVar(&influxOpts.Gzip, "influx-gzip", true, "Compress HTTP writes to InfluxDB")
+	flag.BoolVar(&historyEnabled, "history", false, "Record sensor values in the state directory")
+	historyRetention := flag.String("history-retention", "raw=2d,1m=30d,15m=365d", "Comma-separated list of history tiers with step (or raw) and retention")
+	flag.StringVar(&filterMode, "filter", "", "Comma-separated list of filters from the sensor definition file to enable")
+
+	flag.StringVar(&stateDir, "state-dir", "/var/lib/modbus-sniffer", "Directory for persisted state")
+	flag.DurationVar(&stateInterval, "state-interval", 5*time.Minute, "Interval for persisting state")
+	flag.StringVar(&timezone, "timezone", "Local", "Timezone for resetting meters")
+
+	flag.Float64Var(&publishBudget, "publish-budget", 0, "Maximum number of published values per second (0 for unlimited)")
+	flag.IntVar(&publishBurst, "publish-burst", 50, "Maximum number of values published at once when the budget is limited")
 
 	flag.Parse()
 
+	// Defaults are taken from the environment after parsing so that -help does not print secrets
+	for _, e := range []struct {
+		value *string
+		env   string
+	}{
+		{&mqttOpts.Username, "MQTT_USERNAME"},
+		{&mqttOpts.Password, "MQTT_PASSWORD"},
+		{&influxOpts.Password, "INFLUX_PASSWORD"},
+		{&influxOpts.Token, "INFLUX_TOKEN"},
+	} {
+		if *e.value == "" {
+			*e.value = os.Getenv(e.env)
+		}
+	}
+
+	if *qos > 2 {
+		return fmt.Errorf("invalid MQTT QoS level: %d", *qos)
+	}
+
+	mqttQoS = byte(*qos)
+
+	if stateInterval <= 0 {
+		return fmt.Errorf("invalid state interval: %s", stateInterval)
+	}
+
+	if httpAuthFile != "" {
+		if httpOpts.Auth, err = ReadAuth(httpAuthFile); err != nil {
+			return fmt.Errorf("failed to read HTTP authentication file: %w", err)
+		}
+
+		if httpOpts.CertFile == "" && !httpOpts.SelfSigned {
+			slog.Warn("HTTP authentication is enabled without TLS, credentials are sent in clear text")
+		}
+	}
+
+	if httpOpts.Allow, err = ParseAllowList(httpAllowedHosts); err != nil {
+		return fmt.Errorf("invalid HTTP allow list: %w", err)
+	}
+
+	if historyEnabled {
+		if historyTiers, err = ParseHistoryTiers(*historyRetention); err != nil {
+			return fmt.Errorf("invalid history retention: %w", err)
+		}
+	}
+
+	switch mqttStateMode {
+	case StateModeSensor, StateModeDevice:
+	default:
+		return fmt.Errorf("invalid MQTT state mode: %s", mqttStateMode)
+	}
+
 	if mqttBroker != "" {
 		mqttOpts.AddBroker(mqttBroker)
 
-		if mqttOpts.Username == "" || mqttOpts.Password == "" {
-			return fmt.Errorf("please provide an MQTT username and password via the -mqtt-username, -mqtt-password flags")
+		if mqttUsernameFile != "" {
+			if mqttOpts.Username, err = readSecret(mqttUsernameFile); err != nil {
+				return fmt.Errorf("failed to read MQTT username: %w", err)
+			}
+		}
+
+		if mqttPasswordFile != "" {
+			if mqttOpts.Password, err = readSecret(mqttPasswordFile); err != nil {
+				return fmt.Errorf("failed to read MQTT password: %w", err)
+			}
+		}
+
+		if mqttOpts.Password != "" && mqttOpts.Username == "" {
+			return fmt.Errorf("an MQTT password requires an MQTT username")
+		}
+
+		if mqttTLS.Enabled() {
+			tlsCfg, err := mqttTLS.Config()
+			if err != nil {
+				return fmt.Errorf("failed to setup MQTT TLS: %w", err)
+			}
+
+			mqttOpts.SetTLSConfig(tlsCfg)
 		}
 	}
 
@@ -92,9 +243,7 @@ func parseFlags() (err error) {
 
 		if pid, err = strconv.Atoi(pidOrProcess); err != nil {
 			if pid, err = pidof(pidOrProcess); err != nil {
-				return fmt.Errorf("failed to find pid of process",
-					slog.String("process", pidOrProcess),
-					slog.Any("error", err))
+				return fmt.Errorf("failed to find pid of process %s: %w", pidOrProcess, err)
 			}
 
 			slog.Debug("Detected PID of process",
@@ -113,39 +262,83 @@ func main() {
 	var reader *csv.Reader
 	var writer *csv.Writer
 	var mqttClient *MQTTClient
+	var tracker *DiscoveryTracker
 
 	if err := parseFlags(); err != nil {
 		slog.Error("Failed to parse flags", slog.Any("error", err))
+		return
 	}
 
-	sensorsList, err := ReadSensors(sensorsFile)
+	cfg, err := ReadConfig(sensorsFile)
 	if err != nil {
 		slog.Error("Failed to parse sensor list", slog.Any("error", err))
 		return
 	}
 
+	sensorsList := cfg.Sensors
+
 	if device, err := ReadDevice(deviceFile); err != nil {
 		slog.Error("Failed to parse device information", slog.Any("error", err))
 		return
 	} else if device != nil {
+		// The legacy device definition applies to all sensors without a device
 		for i := range sensorsList {
-			sensorsList[i].Device = device
+			if sensorsList[i].Device == nil {
+				sensorsList[i].Device = device
+			}
 		}
 	}
 
 	slog.Info("Loaded sensors", slog.Int("count", len(sensorsList)))
 
 	messages := make(chan Message, 100)
+	metrics.SetBacklog(func() int { return len(messages) })
+	remote := make(chan Update, 100)
+	detached := make(chan int, len(pids))
 	quantities := map[uint16]Quantity{}
-	sensors := map[uint16]Sensor{}
+	sensors := map[uint16]*Sensor{}
+
+	var filterNames []string
+	if filterMode != "" {
+		filterNames = strings.Split(filterMode, ",")
+	}
+
+	filter, sensorFilters, err := cfg.Filter(filterNames)
+	if err != nil {
+		slog.Error("Failed to setup filters", slog.Any("error", err))
+		return
+	}
+
+	for i := range sensorsList {
+		sensor := &sensorsList[i]
+		if sensor.Quantity == nil {
+			continue
+		}
 
-	for _, sensor := range sensorsList {
 		reg := sensor.Quantity.Register
 
-		quantities[reg] = sensor.Quantity
+		sensor.Quantity.filter = sensorFilters[sensor]
+
+		quantities[reg] = *sensor.Quantity
 		sensors[reg] = sensor
 	}
 
+	dec := NewDecoder(filter, quantities)
+	info := NewDeviceInfoUpdater(sensorsList, dec)
+	checker := NewChecker(sensorsList)
+	throttler := NewThrottler(sensorsList, publishBudget, publishBurst)
+
+	comp, err := NewComputer(sensorsList, dec)
+	if err != nil {
+		slog.Error("Failed to parse computed sensors", slog.Any("error", err))
+		return
+	}
+
+	if err := comp.LoadState(); err != nil {
+		slog.Error("Failed to load state", slog.Any("error", err))
+		return
+	}
+
 	if fromFile != "" {
 		reader, err = openReader(fromFile)
 		if err != nil {
@@ -170,7 +363,11 @@ func main() {
 		go func() {
 			for {
 				message, err := ReadMessage(reader)
-				if err != nil {
+				if errors.Is(err, io.EOF) {
+					slog.Info("Finished reading messages from file")
+					close(messages)
+					return
+				} else if err != nil {
 					log.Fatalf("Failed to read message from file: %s", err)
 				}
 
@@ -179,73 +376,269 @@ func main() {
 		}()
 	} else {
 		for _, pid := range pids {
+			metrics.Tracee(pid, true)
+
 			go func(pid int) {
 				if err := monitor(pid, messages); err != nil {
 					slog.Error("Failed to ptrace serial communication", slog.Any("error", err))
-					return
 				}
+
+				detached <- pid
 			}(pid)
 		}
 	}
 
 	if mqttBroker != "" {
-		if mqttClient, err = mqttConnect(mqttOpts); err != nil {
+		var queue *Queue
+		if mqttQueueSize > 0 {
+			if queue, err = NewQueue(statePath("mqtt-queue.jsonl"), mqttQueueSize, mqttQueuePolicy); err != nil {
+				slog.Error("Failed to open MQTT queue", slog.Any("error", err))
+				return
+			}
+
+			metrics.SetMQTTQueue(queue)
+		}
+
+		if mqttClient, err = mqttConnect(mqttOpts, availabilityTopic(), queue); err != nil {
 			slog.Error("Failed to connect to MQTT broker", slog.Any("error", err))
 			return
 		}
-
-		mqttClient.WaitUntilConnected()
+		defer mqttClient.Close()
 
 		if mqttDiscovery {
-			for _, sensor := range sensors {
-				if err := sensor.SendConfig(mqttClient); err != nil {
-					slog.Error("Failed to send MQTT discovery config", slog.Any("error", err))
+			if err := mqttClient.SubscribeHomeAssistantStatus(); err != nil {
+				slog.Error("Failed to subscribe to Home Assistant status", slog.Any("error", err))
+				return
+			}
+
+			if tracker, err = NewDiscoveryTracker(); err != nil {
+				slog.Error("Failed to load discovery topics", slog.Any("error", err))
+				return
+			}
+
+			if mqttDiscoveryClean {
+				var scanned []string
+				if mqttDiscoveryScan {
+					if scanned, err = ScanDiscovery(mqttClient, 2*time.Second); err != nil {
+						slog.Warn("Failed to scan discovery topics", slog.Any("error", err))
+					}
+				}
+
+				RemoveStaleEntities(mqttClient, tracker, scanned, sensorsList, mqttDiscoveryDryRun)
+			}
+		}
+
+		// Inputs of computed sensors might be produced by another sniffer instance
+		if mqttStateMode == StateModeDevice {
+			if err := SubscribeDeviceStates(mqttClient, comp.Inputs(), func(sensor *Sensor, value float32) {
+				remote <- Update{
+					Sensor: sensor,
+					Value:  value,
+					Time:   time.Now(),
+				}
+			}); err != nil {
+				slog.Error("Failed to subscribe to device states", slog.Any("error", err))
+				return
+			}
+		} else {
+			for _, sensor := range comp.Inputs() {
+				if err := sensor.SubscribeState(mqttClient, func(value float32) {
+					remote <- Update{
+						Sensor: sensor,
+						Value:  value,
+						Time:   time.Now(),
+					}
+				}); err != nil {
+					slog.Error("Failed to subscribe to sensor state", slog.String("id", sensor.ObjectID), slog.Any("error", err))
 					return
 				}
+			}
+		}
+	}
+
+	var influx *InfluxSink
+	if influxOpts.URL != "" {
+		influxOpts.Block = reader != nil
 
-				slog.Info("Send MQTT discovery config", slog.String("id", sensor.ObjectID))
+		if influx, err = NewInfluxSink(influxOpts); err != nil {
+			slog.Error("Failed to setup InfluxDB output", slog.Any("error", err))
+			return
+		}
+		defer influx.Close()
+	}
+
+	if historyEnabled {
+		if history, err = NewHistory(statePath("history"), historyTiers, sensorsList); err != nil {
+			slog.Error("Failed to setup history", slog.Any("error", err))
+			return
+		}
+
+		defer func() {
+			if err := history.Close(); err != nil {
+				slog.Error("Failed to write history", slog.Any("error", err))
 			}
+		}()
+	}
+
+	if httpOpts.Addr != "" {
+		dashboardSensors = sensorsList
+
+		srv, err := httpStart(httpOpts)
+		if err != nil {
+			slog.Error("Failed to start HTTP server", slog.Any("error", err))
+			return
 		}
+		defer srv.Shutdown()
 	}
 
-	if httpListenAddr != "" {
-		go httpStart(httpListenAddr)
+	// Outputs which receive all values regardless of the publish settings
+	if influx != nil {
+		stateStore.SubscribeAll(influx.Write)
 	}
 
-	var filter Filter
-	switch filterMode {
-	case "pcs":
-		filter = &PCSFilter{}
+	if history != nil {
+		stateStore.SubscribeAll(history.Add)
 	}
 
-	dec := NewDecoder(filter, quantities)
+	// Like MQTT, the live stream only receives published values
+	stateStore.Subscribe(stream.Update)
 
-	for message := range messages {
-		results := dec.Decode(message)
+	pub := &Publisher{
+		mqtt:       mqttClient,
+		store:      stateStore,
+		throttler:  throttler,
+		discovery:  mqttDiscovery,
+		discovered: map[*Sensor]bool{},
+		tracker:    tracker,
+	}
 
-		for _, result := range results {
-			reg := result.Quantity.Register
+	if mqttStateMode == StateModeDevice {
+		pub.device = NewDeviceState()
+	}
 
-			sensor := sensors[reg]
+	var resync <-chan struct{}
+	if mqttClient != nil {
+		resync = mqttClient.Resync()
+	}
 
-			slog.Info("New value",
-				slog.Int("pid", message.Pid),
-				slog.Int("fd", message.Fd),
-				slog.Any("result", result), slog.Any("sensor", sensor))
+	// Replaying from a file is treated like a single attached tracee
+	attached := len(pids)
+	if reader != nil {
+		attached = 1
+	}
 
-			name := fmt.Sprintf("%#x", reg)
-			lastResponseResult[name] = ResponseStatusResult{
-				Sensor: sensor,
-				Value:  result.Value,
-			}
+	watchdog := NewWatchdog(mqttClient, availabilityTimeout, attached)
+
+	watchdogTicker := time.NewTicker(time.Second)
+	defer watchdogTicker.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-			if mqttClient != nil {
-				sensor.SendState(mqttClient, result.Value)
+	stateTicker := time.NewTicker(stateInterval)
+	defer stateTicker.Stop()
+
+	persist := func() {
+		if err := comp.SaveState(); err != nil {
+			slog.Error("Failed to save state", slog.Any("error", err))
+		}
+
+		if history != nil {
+			if err := history.Flush(); err != nil {
+				slog.Error("Failed to write history", slog.Any("error", err))
 			}
 		}
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			slog.Info("Received signal", slog.Any("signal", sig))
+
+			persist()
+
+			return
+
+		case <-stateTicker.C:
+			persist()
+
+		case <-watchdogTicker.C:
+			watchdog.Check()
+
+		case pid := <-detached:
+			watchdog.Detached(pid)
+
+		case <-resync:
+			pub.Resync()
+
+		case message, ok := <-messages:
+			if !ok {
+				persist()
+
+				return
+			}
+
+			metrics.Message(&message)
+
+			results, transaction := dec.Decode(message)
+
+			for _, result := range results {
+				sensor := sensors[result.Quantity.Register]
+
+				slog.Info("New value",
+					slog.Int("pid", message.Pid),
+					slog.Int("fd", message.Fd),
+					slog.Any("result", result), slog.Any("sensor", sensor))
+
+				upd, ok := checker.Check(Update{
+					Sensor: sensor,
+					Value:  result.Value,
+					Time:   message.Time,
+					Raw:    result.Raw,
+				})
+				if !ok {
+					continue
+				}
+
+				pub.Publish(upd)
+
+				for _, upd := range comp.Update(sensor.ObjectID, upd.Value, upd.Time, true) {
+					pub.Publish(upd)
+				}
+			}
+
+			// Accepted transactions are recorded even if none of their quantities could be decoded
+			if transaction != nil {
+				watchdog.Frame()
+
+				registerImage.Update(transaction)
+				stream.Transaction(transaction)
+
+				if mqttClient != nil && cfg.Raw != nil {
+					cfg.Raw.Publish(mqttClient, transaction)
+				}
+
+				for _, upd := range comp.UpdateRegisters(message.Time) {
+					pub.Publish(upd)
+				}
+			}
+
+			pub.Flush()
+
+			for _, dev := range info.Update() {
+				pub.Rediscover(dev)
+			}
+
+			if writer != nil {
+				message.Write(writer)
+			}
+
+		case upd := <-remote:
+			for _, upd := range comp.Update(upd.Sensor.ObjectID, upd.Value, upd.Time, false) {
+				pub.Publish(upd)
+			}
 
-		if writer != nil {
-			message.Write(writer)
+			pub.Flush()
 		}
 	}
 }
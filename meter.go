@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	// Embed the timezone database as it is missing on the ESS
+	_ "time/tzdata"
+)
+
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+	PeriodYearly  = "yearly"
+)
+
+// Meter counts the increase of a total_increasing sensor within a period.
+type Meter struct {
+	Source   string `json:"source" yaml:"source"`
+	Period   string `json:"period" yaml:"period"`
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+}
+
+// MeterState is the persisted state of a meter.
+type MeterState struct {
+	Value      float64   `json:"value"`
+	LastSource float64   `json:"last_source"`
+	LastReset  time.Time `json:"last_reset"`
+}
+
+type meter struct {
+	*Meter
+	MeterState
+
+	location *time.Location
+}
+
+func newMeter(cfg *Meter) (*meter, error) {
+	tz := cfg.Timezone
+	if tz == "" {
+		tz = timezone
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	return &meter{
+		Meter:    cfg,
+		location: loc,
+	}, nil
+}
+
+// PeriodStart returns the begin of the period which contains ts.
+// Weeks start on Monday.
+func (m *meter) PeriodStart(ts time.Time) time.Time {
+	ts = ts.In(m.location)
+	y, mon, d := ts.Date()
+
+	switch m.Period {
+	case PeriodWeekly:
+		wd := (int(ts.Weekday()) + 6) % 7
+		return time.Date(y, mon, d-wd, 0, 0, 0, 0, m.location)
+
+	case PeriodMonthly:
+		return time.Date(y, mon, 1, 0, 0, 0, 0, m.location)
+
+	case PeriodYearly:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, m.location)
+	}
+
+	return time.Date(y, mon, d, 0, 0, 0, 0, m.location)
+}
+
+func (m *meter) Inputs() ([]string, []uint16) {
+	return []string{m.Source}, nil
+}
+
+func (m *meter) Evaluate(env Env, ts time.Time) (float64, error) {
+	v, ok := env.Value(m.Source)
+	if !ok {
+		return 0, ErrUnknownValue
+	}
+
+	// The first value of the source is only used as a reference
+	initialized := !m.LastReset.IsZero()
+
+	if start := m.PeriodStart(ts); !start.Equal(m.LastReset) {
+		m.Value = 0
+		m.LastReset = start
+	}
+
+	if initialized {
+		if delta := v - m.LastSource; delta >= 0 {
+			m.Value += delta
+		} else {
+			// The source has been reset
+			m.Value += v
+		}
+	}
+
+	m.LastSource = v
+
+	return m.Value, nil
+}
+
+func (m *meter) State() any {
+	return &m.MeterState
+}
+
+func (m *meter) LastResetTime() time.Time {
+	return m.LastReset
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeterPeriodStart(t *testing.T) {
+	utc := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	tests := []struct {
+		period string
+		ts     string
+		want   string
+	}{
+		// Midnight in Berlin is 23:00 UTC in winter and 22:00 UTC in summer
+		{PeriodDaily, "2023-06-15T12:00:00Z", "2023-06-14T22:00:00Z"},
+		{PeriodDaily, "2023-06-14T22:00:00Z", "2023-06-14T22:00:00Z"},
+		{PeriodDaily, "2023-06-14T21:59:59Z", "2023-06-13T22:00:00Z"},
+		{PeriodDaily, "2023-01-15T23:30:00Z", "2023-01-15T23:00:00Z"},
+
+		// Days with a DST transition are 23 and 25 hours long
+		{PeriodDaily, "2023-03-26T12:00:00Z", "2023-03-25T23:00:00Z"},
+		{PeriodDaily, "2023-03-26T22:00:00Z", "2023-03-26T22:00:00Z"},
+		{PeriodDaily, "2023-10-29T12:00:00Z", "2023-10-28T22:00:00Z"},
+		{PeriodDaily, "2023-10-29T22:59:59Z", "2023-10-28T22:00:00Z"},
+		{PeriodDaily, "2023-10-29T23:00:00Z", "2023-10-29T23:00:00Z"},
+
+		// Weeks start on Monday
+		{PeriodWeekly, "2023-06-12T00:00:00+02:00", "2023-06-11T22:00:00Z"},
+		{PeriodWeekly, "2023-06-14T12:00:00Z", "2023-06-11T22:00:00Z"},
+		{PeriodWeekly, "2023-06-18T23:59:59+02:00", "2023-06-11T22:00:00Z"},
+		{PeriodWeekly, "2023-06-19T00:00:00+02:00", "2023-06-18T22:00:00Z"},
+
+		// Weeks spanning a month, a year and a DST transition
+		{PeriodWeekly, "2023-07-02T12:00:00Z", "2023-06-25T22:00:00Z"},
+		{PeriodWeekly, "2024-01-03T12:00:00Z", "2024-01-01T00:00:00+01:00"},
+		{PeriodWeekly, "2023-01-01T12:00:00Z", "2022-12-26T00:00:00+01:00"},
+		{PeriodWeekly, "2023-03-29T12:00:00Z", "2023-03-26T22:00:00Z"},
+		{PeriodWeekly, "2023-03-26T12:00:00Z", "2023-03-19T23:00:00Z"},
+
+		{PeriodMonthly, "2023-03-31T23:00:00Z", "2023-04-01T00:00:00+02:00"},
+		{PeriodMonthly, "2023-03-31T21:59:59Z", "2023-03-01T00:00:00+01:00"},
+		{PeriodMonthly, "2023-11-15T12:00:00Z", "2023-11-01T00:00:00+01:00"},
+
+		{PeriodYearly, "2023-12-31T23:00:00Z", "2024-01-01T00:00:00+01:00"},
+		{PeriodYearly, "2023-12-31T22:59:59Z", "2023-01-01T00:00:00+01:00"},
+		{PeriodYearly, "2023-07-01T12:00:00Z", "2023-01-01T00:00:00+01:00"},
+	}
+
+	for _, tt := range tests {
+		m, err := newMeter(&Meter{
+			Period:   tt.period,
+			Timezone: "Europe/Berlin",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := m.PeriodStart(utc(tt.ts)), utc(tt.want); !got.Equal(want) {
+			t.Errorf("%s period of %s starts at %s, want %s", tt.period, tt.ts, got.UTC().Format(time.RFC3339), want.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+func TestMeterEvaluate(t *testing.T) {
+	m, err := newMeter(&Meter{
+		Source:   "total",
+		Period:   PeriodDaily,
+		Timezone: "UTC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		ts     time.Time
+		source float64
+		want   float64
+	}{
+		{day.Add(1 * time.Hour), 100, 0}, // Reference only
+		{day.Add(2 * time.Hour), 103, 3},
+		{day.Add(3 * time.Hour), 110, 10},
+		{day.Add(4 * time.Hour), 2, 12}, // Source has been reset
+		{day.Add(25 * time.Hour), 5, 3}, // Next day
+		{day.Add(26 * time.Hour), 5, 3},
+	}
+
+	for i, s := range steps {
+		env := testEnv{
+			values: map[string]float64{"total": s.source},
+		}
+
+		got, err := m.Evaluate(env, s.ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != s.want {
+			t.Errorf("step %d: value = %v, want %v", i, got, s.want)
+		}
+	}
+
+	if want := day.Add(24 * time.Hour); !m.LastResetTime().Equal(want) {
+		t.Errorf("last reset = %s, want %s", m.LastResetTime(), want)
+	}
+
+	if _, err := m.Evaluate(testEnv{}, day); err == nil {
+		t.Error("expected error for unknown source")
+	}
+}
+
+func TestMeterInvalidTimezone(t *testing.T) {
+	if _, err := newMeter(&Meter{Source: "total", Timezone: "Mars/Olympus_Mons"}); err == nil {
+		t.Error("expected error")
+	}
+}
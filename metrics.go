@@ -0,0 +1,495 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+const metricsPrefix = "modbus_sniffer"
+
+// Buckets of the transaction latency histogram in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type messageKey struct {
+	pid, fd   int
+	direction Direction
+}
+
+type rejectKey struct {
+	sensor, reason string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.buckets[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+// Metrics collects the internal counters for the Prometheus endpoint.
+// The last sensor values are taken from the state store.
+//
+// The text exposition format is written directly as it is simple enough
+// and saves us from pulling in the Prometheus client library.
+type Metrics struct {
+	messages map[messageKey]uint64
+
+	framesDecoded  uint64
+	framesFiltered uint64
+	crcErrors      uint64
+	decodeErrors   uint64
+
+	mqttPublishes uint64
+	mqttFailures  uint64
+
+	publishDropped uint64
+
+	rejected map[rejectKey]uint64
+
+	latency map[byte]*histogram // Per unit
+
+	tracees   map[int]bool // Attached state by pid
+	available bool
+
+	// Returns the number of captured messages waiting to be processed
+	backlog func() int
+
+	mqttQueue *Queue
+
+	mutex sync.Mutex
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messages: map[messageKey]uint64{},
+		rejected: map[rejectKey]uint64{},
+		latency:  map[byte]*histogram{},
+		tracees:  map[int]bool{},
+	}
+}
+
+func (m *Metrics) Message(msg *Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.messages[messageKey{msg.Pid, msg.Fd, msg.Direction}]++
+}
+
+func (m *Metrics) FrameDecoded(t *Transaction) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.framesDecoded++
+
+	h, ok := m.latency[t.Unit]
+	if !ok {
+		h = &histogram{}
+		m.latency[t.Unit] = h
+	}
+
+	h.observe(t.Latency)
+}
+
+func (m *Metrics) FrameFiltered() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.framesFiltered++
+}
+
+// ParseError counts a frame which could not be parsed.
+func (m *Metrics) ParseError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err == ErrInvalidChecksum {
+		m.crcErrors++
+	} else {
+		m.decodeErrors++
+	}
+}
+
+// ValueRejected counts an implausible value and returns the number of values rejected for the same reason.
+func (m *Metrics) ValueRejected(sensor, reason string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	k := rejectKey{sensor, reason}
+	m.rejected[k]++
+
+	return m.rejected[k]
+}
+
+func (m *Metrics) MQTTPublish() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.mqttPublishes++
+}
+
+func (m *Metrics) MQTTFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.mqttFailures++
+}
+
+// PublishDropped counts an update which is not published due to an exhausted publish budget.
+func (m *Metrics) PublishDropped() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.publishDropped++
+}
+
+// Tracee records whether a traced process is attached.
+func (m *Metrics) Tracee(pid int, attached bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.tracees[pid] = attached
+}
+
+func (m *Metrics) SetAvailable(available bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.available = available
+}
+
+// SetBacklog registers a function which returns the length of the message queue.
+func (m *Metrics) SetBacklog(fn func() int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.backlog = fn
+}
+
+// SetMQTTQueue registers the queue of outbound MQTT messages.
+func (m *Metrics) SetMQTTQueue(q *Queue) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.mqttQueue = q
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	// Taken before locking to keep the lock order independent of the store
+	snap := stateStore.Snapshot()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+
+	family := func(name, typ, help string) string {
+		name = metricsPrefix + "_" + name
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		return name
+	}
+
+	sample := func(name string, labels []string, v float64) {
+		b.WriteString(name)
+
+		if len(labels) > 0 {
+			b.WriteByte('{')
+			for i := 0; i+1 < len(labels); i += 2 {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+			}
+			b.WriteByte('}')
+		}
+
+		fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+	}
+
+	// Sensors
+	gauges := []Update{}
+	counters := []Update{}
+	for _, v := range snap.Values {
+		upd := v.Update
+		if upd.Sensor.StateClass == StateClassTotalIncreasing {
+			counters = append(counters, upd)
+		} else {
+			gauges = append(gauges, upd)
+		}
+	}
+
+	for _, f := range []struct {
+		updates   []Update
+		name, typ string
+		help      string
+	}{
+		{gauges, "sensor", "gauge", "Last value of a sensor."},
+		{counters, "sensor_total", "counter", "Last value of a monotonically increasing sensor."},
+	} {
+		if len(f.updates) == 0 {
+			continue
+		}
+
+		sort.Slice(f.updates, func(i, j int) bool {
+			return f.updates[i].Sensor.ObjectID < f.updates[j].Sensor.ObjectID
+		})
+
+		name := family(f.name, f.typ, f.help)
+		for _, upd := range f.updates {
+			s := upd.Sensor
+
+			device := ""
+			if s.Device != nil {
+				device = s.Device.Name
+			}
+
+			sample(name, []string{
+				"object_id", s.ObjectID,
+				"unit", s.UnitOfMeasurement,
+				"device", device,
+			}, float64(upd.Value))
+		}
+	}
+
+	// Captured messages
+	keys := []messageKey{}
+	for k := range m.messages {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		x, y := keys[i], keys[j]
+		if x.pid != y.pid {
+			return x.pid < y.pid
+		}
+		if x.fd != y.fd {
+			return x.fd < y.fd
+		}
+		return x.direction < y.direction
+	})
+
+	name := family("messages_total", "counter", "Number of captured messages.")
+	for _, k := range keys {
+		sample(name, []string{
+			"pid", strconv.Itoa(k.pid),
+			"fd", strconv.Itoa(k.fd),
+			"direction", k.direction.String(),
+		}, float64(m.messages[k]))
+	}
+
+	// Tracees
+	if len(m.tracees) > 0 {
+		pids := []int{}
+		for pid := range m.tracees {
+			pids = append(pids, pid)
+		}
+
+		sort.Ints(pids)
+
+		name = family("tracee_attached", "gauge", "Whether a traced process is attached.")
+		for _, pid := range pids {
+			sample(name, []string{"pid", strconv.Itoa(pid)}, boolToFloat(m.tracees[pid]))
+		}
+	}
+
+	sample(family("available", "gauge", "Whether valid frames are received."), nil, boolToFloat(m.available))
+
+	// Frames
+	sample(family("frames_decoded_total", "counter", "Number of accepted responses."), nil, float64(m.framesDecoded))
+	sample(family("frames_filtered_total", "counter", "Number of responses rejected by filters."), nil, float64(m.framesFiltered))
+	sample(family("crc_errors_total", "counter", "Number of frames with an invalid checksum."), nil, float64(m.crcErrors))
+	sample(family("decode_errors_total", "counter", "Number of frames or quantities which could not be decoded."), nil, float64(m.decodeErrors))
+
+	if len(m.rejected) > 0 {
+		keys := []rejectKey{}
+		for k := range m.rejected {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].sensor != keys[j].sensor {
+				return keys[i].sensor < keys[j].sensor
+			}
+			return keys[i].reason < keys[j].reason
+		})
+
+		name = family("values_rejected_total", "counter", "Number of implausible values rejected by the limits of a sensor.")
+		for _, k := range keys {
+			sample(name, []string{
+				"object_id", k.sensor,
+				"reason", k.reason,
+			}, float64(m.rejected[k]))
+		}
+	}
+
+	if m.backlog != nil {
+		sample(family("message_backlog", "gauge", "Number of captured messages waiting to be processed."), nil, float64(m.backlog()))
+	}
+
+	// MQTT
+	sample(family("mqtt_publishes_total", "counter", "Number of MQTT messages published or queued."), nil, float64(m.mqttPublishes))
+	sample(family("mqtt_publish_failures_total", "counter", "Number of MQTT messages which could not be published."), nil, float64(m.mqttFailures))
+	if q := m.mqttQueue; q != nil {
+		queued, dropped := q.Stats()
+
+		sample(family("mqtt_queue_length", "gauge", "Number of MQTT messages waiting in the queue."), nil, float64(q.Len()))
+		sample(family("mqtt_queue_queued_total", "counter", "Number of MQTT messages queued while the broker was unreachable."), nil, float64(queued))
+		sample(family("mqtt_queue_dropped_total", "counter", "Number of queued MQTT messages dropped due to the queue size."), nil, float64(dropped))
+	}
+
+	sample(family("publish_budget_dropped_total", "counter", "Number of updates not published due to an exhausted publish budget."), nil, float64(m.publishDropped))
+
+	// Latency
+	units := []int{}
+	for unit := range m.latency {
+		units = append(units, int(unit))
+	}
+
+	sort.Ints(units)
+
+	name = family("transaction_latency_seconds", "histogram", "Time between request and response.")
+	for _, unit := range units {
+		h := m.latency[byte(unit)]
+		u := strconv.Itoa(unit)
+
+		for i, le := range latencyBuckets {
+			sample(name+"_bucket", []string{"unit", u, "le", strconv.FormatFloat(le, 'g', -1, 64)}, float64(h.buckets[i]))
+		}
+
+		sample(name+"_bucket", []string{"unit", u, "le", "+Inf"}, float64(h.count))
+		sample(name+"_sum", []string{"unit", u}, h.sum)
+		sample(name+"_count", []string{"unit", u}, float64(h.count))
+	}
+
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err
+}
+
+// MetricsQueue are the counters of the MQTT queue.
+type MetricsQueue struct {
+	Length  int
+	Queued  uint64
+	Dropped uint64
+}
+
+// MetricsSnapshot is a copy of the metrics for the dashboard.
+type MetricsSnapshot struct {
+	Available bool
+	Tracees   map[int]bool
+	Messages  map[messageKey]uint64
+
+	FramesDecoded  uint64
+	FramesFiltered uint64
+	CRCErrors      uint64
+	DecodeErrors   uint64
+	MQTTPublishes  uint64
+	MQTTFailures   uint64
+	PublishDropped uint64
+	Backlog        int
+
+	// Only set if the MQTT queue is enabled
+	MQTTQueue *MetricsQueue
+
+	Rejected map[string]map[string]uint64 // By sensor and reason
+	Latency  map[byte]histogram
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := MetricsSnapshot{
+		Available:      m.available,
+		Tracees:        map[int]bool{},
+		Messages:       map[messageKey]uint64{},
+		FramesDecoded:  m.framesDecoded,
+		FramesFiltered: m.framesFiltered,
+		CRCErrors:      m.crcErrors,
+		DecodeErrors:   m.decodeErrors,
+		MQTTPublishes:  m.mqttPublishes,
+		MQTTFailures:   m.mqttFailures,
+		PublishDropped: m.publishDropped,
+		Rejected:       map[string]map[string]uint64{},
+		Latency:        map[byte]histogram{},
+	}
+
+	for k, v := range m.tracees {
+		s.Tracees[k] = v
+	}
+
+	for k, v := range m.messages {
+		s.Messages[k] = v
+	}
+
+	for k, n := range m.rejected {
+		if s.Rejected[k.sensor] == nil {
+			s.Rejected[k.sensor] = map[string]uint64{}
+		}
+
+		s.Rejected[k.sensor][k.reason] = n
+	}
+
+	for k, v := range m.latency {
+		s.Latency[k] = histogram{
+			count: v.count,
+			sum:   v.sum,
+		}
+	}
+
+	if m.backlog != nil {
+		s.Backlog = m.backlog()
+	}
+
+	if q := m.mqttQueue; q != nil {
+		s.MQTTQueue = &MetricsQueue{
+			Length: q.Len(),
+		}
+
+		s.MQTTQueue.Queued, s.MQTTQueue.Dropped = q.Stats()
+	}
+
+	return s
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func httpHandleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if _, err := metrics.WriteTo(w); err != nil {
+		slog.Error("Failed to write response", slog.Any("error", err))
+	}
+}
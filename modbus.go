@@ -6,20 +6,44 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/howeyc/crc16"
 	"golang.org/x/exp/slog"
 )
 
-type FilterFunc func(req *ReadHoldingRegistersRequest, resp *ReadHoldingRegistersResponse) bool
-
 type Decoder struct {
 	responseBuffer []byte
 	requestBuffer  []byte
 
-	lastRequest *ReadHoldingRegistersRequest
-	quantities  map[uint16]Quantity
-	filter      Filter
+	lastRequest      *ReadHoldingRegistersRequest
+	lastRequestTime  time.Time
+	lastIdentRequest *ReadDeviceIdentificationRequest
+	objects          map[byte]string
+	quantities       map[uint16]Quantity
+	registers        map[uint16]uint16
+	filter           Filter
+}
+
+// Transaction is a request together with its accepted response.
+type Transaction struct {
+	Time         time.Time `json:"time"`
+	Pid          int       `json:"pid"`
+	Fd           int       `json:"fd"`
+	Unit         byte      `json:"unit"`
+	FunctionCode byte      `json:"function_code"`
+	Address      uint16    `json:"address"`
+	Registers    []uint16  `json:"registers"`
+	Latency      float64   `json:"latency"` // Time between request and response in seconds
+
+	message  *Message
+	request  *ReadHoldingRegistersRequest
+	response *ReadHoldingRegistersResponse
+}
+
+// Filter applies a filter to the frames of the transaction.
+func (t *Transaction) Filter(f Filter) bool {
+	return f.Filter(t.message, t.request, t.response)
 }
 
 type ReadHoldingRegistersRequest struct {
@@ -57,7 +81,7 @@ func NewReadHoldingRegistersRequest(b []byte) (*ReadHoldingRegistersRequest, []b
 	}
 
 	if r.Checksum != ^crc16.ChecksumIBM(b[0:6]) {
-		return nil, nil, fmt.Errorf("invalid checksum")
+		return nil, nil, ErrInvalidChecksum
 	}
 
 	return r, []byte{}, nil
@@ -94,7 +118,7 @@ func NewReadHoldingRegistersResponse(b []byte) (*ReadHoldingRegistersResponse, [
 	}
 
 	if r.Checksum != ^crc16.ChecksumIBM(b[0:3+cnt]) {
-		return nil, nil, fmt.Errorf("invalid checksum")
+		return nil, nil, ErrInvalidChecksum
 	}
 
 	return r, b[5+cnt:], nil
@@ -103,46 +127,97 @@ func NewReadHoldingRegistersResponse(b []byte) (*ReadHoldingRegistersResponse, [
 func NewDecoder(filter Filter, quants map[uint16]Quantity) *Decoder {
 	return &Decoder{
 		quantities: quants,
+		registers:  map[uint16]uint16{},
+		objects:    map[byte]string{},
 		filter:     filter,
 	}
 }
 
-func (d *Decoder) Decode(m Message) []Result {
+// Object returns the last value of a device identification object (function code 43).
+func (d *Decoder) Object(id byte) (string, bool) {
+	v, ok := d.objects[id]
+	return v, ok
+}
+
+// Register returns the last value of a register which has been observed in an accepted response.
+func (d *Decoder) Register(addr uint16) (uint16, bool) {
+	v, ok := d.registers[addr]
+	return v, ok
+}
+
+// Decode processes a message and returns the decoded results together with the transaction.
+// It returns a nil transaction if the message did not complete an accepted response.
+// Quantities which fail to decode are skipped, but the transaction is still accepted.
+func (d *Decoder) Decode(m Message) ([]Result, *Transaction) {
 	results := []Result{}
 
 	switch m.Direction {
 
-	// This is a normal Modbus read holding registers request
 	case DirectionWrite:
+		if isReadDeviceIdentification(m.Buffer) {
+			rr, rem, err := NewReadDeviceIdentificationRequest(m.Buffer)
+			if err != nil {
+				if err != ErrNotEnoughData {
+					metrics.ParseError(err)
+					slog.Error("Failed to parse read device identification request", slog.Any("error", err))
+				}
+				return nil, nil
+			}
+
+			d.lastRequest = nil
+			d.lastIdentRequest = rr
+
+			slog.Debug("ReadDeviceIdentificationRequest", slog.Any("object", rr.ObjectID), slog.Any("unit", rr.Unit))
+
+			d.requestBuffer = rem
+			d.responseBuffer = []byte{}
+
+			return nil, nil
+		}
+
+		// This is a normal Modbus read holding registers request
 		rr, rem, err := NewReadHoldingRegistersRequest(m.Buffer)
 		if err != nil {
 			if err != ErrNotEnoughData {
+				metrics.ParseError(err)
 				slog.Error("Failed to parse read holding register request", slog.Any("error", err))
 			}
-			return nil
+			return nil, nil
 		}
 
 		d.lastRequest = rr
+		d.lastRequestTime = m.Time
+		d.lastIdentRequest = nil
+
+		registerImage.Poll(rr, m.Time)
 
 		slog.Debug("ReadHoldingRegistersRequest", slog.Any("addr", rr.Address), slog.Any("count", rr.RegisterCount), slog.Any("unit", rr.Unit))
 
 		d.requestBuffer = rem
 		d.responseBuffer = []byte{}
 
+		return nil, nil
+
 	case DirectionRead:
 		d.responseBuffer = append(d.responseBuffer, m.Buffer...)
 
+		if d.lastIdentRequest != nil {
+			d.decodeDeviceIdentification()
+			return nil, nil
+		}
+
 		if d.lastRequest == nil {
 			slog.Error("No request yet")
-			return nil
+			return nil, nil
 		}
 
 		rr, rem, err := NewReadHoldingRegistersResponse(d.responseBuffer)
 		if err != nil {
 			if err != ErrNotEnoughData {
+				metrics.ParseError(err)
 				slog.Error("Failed to parse holding registers response", slog.Any("error", err))
 			}
-			return nil
+			return nil, nil
 		}
 
 		regs := []string{}
@@ -152,20 +227,47 @@ func (d *Decoder) Decode(m Message) []Result {
 
 		slog.Debug("ReadHoldingRegistersResponse", slog.Any("count", rr.ByteCount), slog.Any("unit", rr.Unit), slog.Any("register", regs))
 
-		if d.filter != nil && !d.filter.Filter(d.lastRequest, rr) {
+		if d.filter != nil && !d.filter.Filter(&m, d.lastRequest, rr) {
 			slog.Debug("Skipping filtered response")
-			return nil
+			metrics.FrameFiltered()
+			return nil, nil
 		}
 
+		for i, r := range rr.Registers {
+			d.registers[d.lastRequest.Address+uint16(i)] = r
+		}
+
+		t := &Transaction{
+			Time:         m.Time,
+			Pid:          m.Pid,
+			Fd:           m.Fd,
+			Unit:         rr.Unit,
+			FunctionCode: rr.FunctionCode,
+			Address:      d.lastRequest.Address,
+			Registers:    rr.Registers,
+			Latency:      m.Time.Sub(d.lastRequestTime).Seconds(),
+			message:      &m,
+			request:      d.lastRequest,
+			response:     rr,
+		}
+
+		metrics.FrameDecoded(t)
+
 		for addr, quant := range d.quantities {
 			var off int = int(addr) - int(d.lastRequest.Address)
 			if off >= 0 && off+quant.Size <= len(rr.Registers) {
+				if quant.filter != nil && !quant.filter.Filter(&m, d.lastRequest, rr) {
+					slog.Debug("Skipping filtered quantity", slog.String("register", fmt.Sprintf("%#x", addr)))
+					continue
+				}
+
 				regs := rr.Registers[off : off+quant.Size]
 
 				result, err := quant.Decode(regs)
 				if err != nil {
-					slog.Error("Failed to decode quantity", slog.Any("error", err))
-					return nil
+					metrics.ParseError(err)
+					slog.Error("Failed to decode quantity", slog.String("register", fmt.Sprintf("%#x", addr)), slog.Any("error", err))
+					continue
 				}
 
 				results = append(results, result)
@@ -173,7 +275,28 @@ func (d *Decoder) Decode(m Message) []Result {
 		}
 
 		d.responseBuffer = rem
+
+		return results, t
+	}
+
+	return nil, nil
+}
+
+func (d *Decoder) decodeDeviceIdentification() {
+	rr, rem, err := NewReadDeviceIdentificationResponse(d.responseBuffer)
+	if err != nil {
+		if err != ErrNotEnoughData {
+			metrics.ParseError(err)
+			slog.Error("Failed to parse read device identification response", slog.Any("error", err))
+		}
+		return
+	}
+
+	slog.Debug("ReadDeviceIdentificationResponse", slog.Any("unit", rr.Unit), slog.Any("objects", rr.Objects))
+
+	for id, v := range rr.Objects {
+		d.objects[id] = v
 	}
 
-	return results
+	d.responseBuffer = rem
 }
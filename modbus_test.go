@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/howeyc/crc16"
+)
+
+func withChecksum(b []byte) []byte {
+	return binary.LittleEndian.AppendUint16(b, ^crc16.ChecksumIBM(b))
+}
+
+func readRequest(unit byte, addr, count uint16) []byte {
+	b := []byte{unit, 3}
+	b = binary.BigEndian.AppendUint16(b, addr)
+	b = binary.BigEndian.AppendUint16(b, count)
+
+	return withChecksum(b)
+}
+
+func readResponse(unit byte, regs ...uint16) []byte {
+	b := []byte{unit, 3, byte(2 * len(regs))}
+	for _, r := range regs {
+		b = binary.BigEndian.AppendUint16(b, r)
+	}
+
+	return withChecksum(b)
+}
+
+func TestDecoder(t *testing.T) {
+	quantities := map[uint16]Quantity{
+		0x101: {Register: 0x101, Size: 1, Scale: 0.1},
+		0x200: {Register: 0x200, Size: 1, Scale: 1},
+	}
+
+	one := int64(1)
+	unit1 := &FilterRule{Unit: ValueMatch{{Min: &one, Max: &one}}}
+
+	type frame struct {
+		dir Direction
+		buf []byte
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		frames []frame
+		values []float32 // Decoded values of the last frame
+		regs   []uint16  // Registers of the accepted transaction, nil if none
+	}{
+		{"accepted", nil, []frame{
+			{DirectionWrite, readRequest(1, 0x100, 2)},
+			{DirectionRead, readResponse(1, 7, 1234)},
+		}, []float32{123.4}, []uint16{7, 1234}},
+
+		{"without quantities", nil, []frame{
+			{DirectionWrite, readRequest(1, 0x300, 1)},
+			{DirectionRead, readResponse(1, 5)},
+		}, []float32{}, []uint16{5}},
+
+		{"split response", nil, []frame{
+			{DirectionWrite, readRequest(1, 0x200, 1)},
+			{DirectionRead, readResponse(1, 42)[:3]},
+			{DirectionRead, readResponse(1, 42)[3:]},
+		}, []float32{42}, []uint16{42}},
+
+		{"filtered", unit1, []frame{
+			{DirectionWrite, readRequest(2, 0x100, 2)},
+			{DirectionRead, readResponse(2, 7, 1234)},
+		}, nil, nil},
+
+		{"no request", nil, []frame{
+			{DirectionRead, readResponse(1, 7, 1234)},
+		}, nil, nil},
+
+		{"invalid checksum", nil, []frame{
+			{DirectionWrite, readRequest(1, 0x100, 2)},
+			{DirectionRead, append(readResponse(1, 7, 1234)[:7], 0, 0)},
+		}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(tt.filter, quantities)
+
+			var (
+				results []Result
+				tr      *Transaction
+			)
+
+			for i, f := range tt.frames {
+				results, tr = dec.Decode(Message{
+					Direction: f.dir,
+					Buffer:    f.buf,
+					Time:      time.Unix(int64(i), 0),
+				})
+			}
+
+			if tt.regs == nil {
+				if tr != nil || results != nil {
+					t.Errorf("unexpected transaction %+v with results %v", tr, results)
+				}
+				return
+			}
+
+			if tr == nil {
+				t.Fatal("no transaction")
+			}
+
+			if !reflect.DeepEqual(tr.Registers, tt.regs) {
+				t.Errorf("got registers %v, want %v", tr.Registers, tt.regs)
+			}
+
+			values := []float32{}
+			for _, r := range results {
+				values = append(values, r.Value)
+			}
+
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("got values %v, want %v", values, tt.values)
+			}
+		})
+	}
+}
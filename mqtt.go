@@ -5,47 +5,330 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/url"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"golang.org/x/exp/slog"
 )
 
+const (
+	AvailabilityOnline  = "online"
+	AvailabilityOffline = "offline"
+)
+
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
 type MQTTClient struct {
 	mqtt.Client
 
-	connected sync.WaitGroup
+	// Holds outbound messages while the broker is unreachable
+	queue         *Queue
+	draining      bool
+	drainingMutex sync.Mutex
+
+	// Signaled after every (re)connect and when Home Assistant comes online
+	resync chan struct{}
+
+	subscriptions      map[string]subscription
+	subscriptionsMutex sync.Mutex
+
+	availabilityTopic string
+	available         bool
+	availableMutex    sync.Mutex
 }
 
-func mqttConnect(opts *mqtt.ClientOptions) (*MQTTClient, error) {
-	client := &MQTTClient{}
+func mqttConnect(opts *mqtt.ClientOptions, availabilityTopic string, queue *Queue) (*MQTTClient, error) {
+	client := &MQTTClient{
+		queue:             queue,
+		resync:            make(chan struct{}, 1),
+		subscriptions:     map[string]subscription{},
+		availabilityTopic: availabilityTopic,
+		available:         true,
+	}
+
+	// The broker marks us as unavailable if we disconnect unexpectedly
+	opts.SetWill(availabilityTopic, AvailabilityOffline, 1, true)
+
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
 
 	opts.OnConnectAttempt = func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
 		slog.Info("Attempt connection to broker", slog.Any("broker", broker))
 
-		client.connected.Add(1)
-
 		return tlsCfg
 	}
 
 	opts.OnConnect = func(_ mqtt.Client) {
-		slog.Info("Connected to broker")
-		client.connected.Done()
+		client.onConnect()
 	}
 
 	opts.OnConnectionLost = func(c mqtt.Client, err error) {
 		slog.Info("Connection to broker lost", slog.Any("error", err))
+		stream.Event("mqtt", "Connection to broker lost", "", "connected", false, "error", fmt.Sprint(err))
 	}
 
 	client.Client = mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+
+	// We do not wait for the connection as messages are queued until the broker is reachable
+	token := client.Connect()
+	if token.WaitTimeout(opts.ConnectTimeout) && token.Error() != nil {
 		return nil, token.Error()
 	}
 
 	return client, nil
 }
 
-func (c *MQTTClient) WaitUntilConnected() {
-	c.connected.Wait()
+// onConnect restores the state of the session after every (re)connect.
+func (c *MQTTClient) onConnect() {
+	slog.Info("Connected to broker")
+	stream.Event("mqtt", "Connected to broker", "", "connected", true)
+
+	// Birth message
+	c.availableMutex.Lock()
+	c.publishAvailability()
+	c.availableMutex.Unlock()
+
+	// Subscriptions are not restored by the broker as we use a clean session
+	c.subscriptionsMutex.Lock()
+	for topic, sub := range c.subscriptions {
+		c.subscribe(topic, sub)
+	}
+	c.subscriptionsMutex.Unlock()
+
+	c.drain()
+	c.triggerResync()
+}
+
+// Publish sends a message or queues it if the broker is unreachable.
+// Messages are also queued while older ones are still pending to retain their order.
+func (c *MQTTClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	metrics.MQTTPublish()
+
+	if c.queue == nil {
+		return c.publish(topic, qos, retained, payload)
+	}
+
+	c.drainingMutex.Lock()
+	defer c.drainingMutex.Unlock()
+
+	if c.IsConnectionOpen() && !c.draining && c.queue.Len() == 0 {
+		return c.publish(topic, qos, retained, payload)
+	}
+
+	var buf []byte
+	switch p := payload.(type) {
+	case string:
+		buf = []byte(p)
+	case []byte:
+		buf = p
+	default:
+		buf = []byte(fmt.Sprint(p))
+	}
+
+	c.queue.Push(QueuedMessage{
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  buf,
+		Time:     time.Now(),
+	})
+
+	return completedToken{}
+}
+
+// publish sends a message and counts failures.
+func (c *MQTTClient) publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	token := c.Client.Publish(topic, qos, retained, payload)
+
+	go func() {
+		<-token.Done()
+
+		if token.Error() != nil {
+			metrics.MQTTFailure()
+			slog.Warn("Failed to publish", slog.String("topic", topic), slog.Any("error", token.Error()))
+		}
+	}()
+
+	return token
+}
+
+// drain publishes all queued messages in order.
+func (c *MQTTClient) drain() {
+	if c.queue == nil {
+		return
+	}
+
+	c.drainingMutex.Lock()
+	if c.draining {
+		c.drainingMutex.Unlock()
+		return
+	}
+	c.draining = true
+	c.drainingMutex.Unlock()
+
+	go func() {
+		sent := 0
+
+		for {
+			if m, ok := c.queue.Peek(); ok && c.IsConnectionOpen() {
+				token := c.Client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+				if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+					metrics.MQTTFailure()
+					slog.Warn("Failed to publish queued message", slog.String("topic", m.Topic), slog.Any("error", token.Error()))
+
+					// Retried as long as the connection is open
+					time.Sleep(5 * time.Second)
+					continue
+				}
+
+				c.queue.Pop(m)
+				sent++
+				continue
+			}
+
+			// Publish queues new messages while we are draining.
+			// Hence, we check the queue again before we stop.
+			c.drainingMutex.Lock()
+
+			if c.IsConnectionOpen() && c.queue.Len() > 0 {
+				c.drainingMutex.Unlock()
+				continue
+			}
+
+			c.draining = false
+
+			if err := c.queue.Sync(); err != nil {
+				slog.Error("Failed to sync queue file", slog.Any("error", err))
+			}
+
+			c.drainingMutex.Unlock()
+			break
+		}
+
+		if sent > 0 {
+			slog.Info("Published queued messages", slog.Int("count", sent), slog.Int("remaining", c.queue.Len()))
+		}
+	}()
+}
+
+// Resync returns a channel which is signaled whenever discovery configs and states should be sent again.
+func (c *MQTTClient) Resync() <-chan struct{} {
+	return c.resync
+}
+
+func (c *MQTTClient) triggerResync() {
+	select {
+	case c.resync <- struct{}{}:
+	default:
+	}
+}
+
+// AddSubscription subscribes to a topic and restores the subscription after reconnects.
+func (c *MQTTClient) AddSubscription(topic string, qos byte, handler mqtt.MessageHandler) error {
+	sub := subscription{
+		qos:     qos,
+		handler: handler,
+	}
+
+	c.subscriptionsMutex.Lock()
+	c.subscriptions[topic] = sub
+	c.subscriptionsMutex.Unlock()
+
+	if !c.IsConnectionOpen() {
+		return nil
+	}
+
+	token := c.subscribe(topic, sub)
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *MQTTClient) subscribe(topic string, sub subscription) mqtt.Token {
+	token := c.Subscribe(topic, sub.qos, sub.handler)
+
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Failed to subscribe", slog.String("topic", topic), slog.Any("error", token.Error()))
+		}
+	}()
+
+	return token
+}
+
+// SubscribeHomeAssistantStatus resends discovery configs and states when Home Assistant comes online.
+func (c *MQTTClient) SubscribeHomeAssistantStatus() error {
+	topic := hassioMQTTDiscoveryPrefix + "/status"
+
+	return c.AddSubscription(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		status := string(m.Payload())
+
+		slog.Info("Home Assistant status changed", slog.String("status", status))
+
+		if status == AvailabilityOnline {
+			c.triggerResync()
+		}
+	})
+}
+
+// SetAvailable publishes the availability of our sensors if it changed.
+func (c *MQTTClient) SetAvailable(available bool) {
+	c.availableMutex.Lock()
+	defer c.availableMutex.Unlock()
+
+	if c.available == available {
+		return
+	}
+
+	c.available = available
+	c.publishAvailability()
+}
+
+func (c *MQTTClient) publishAvailability() {
+	payload := AvailabilityOffline
+	if c.available {
+		payload = AvailabilityOnline
+	}
+
+	// The birth message is sent after connecting
+	if !c.IsConnectionOpen() {
+		return
+	}
+
+	slog.Info("Publishing availability", slog.String("topic", c.availabilityTopic), slog.String("state", payload))
+
+	// Availability is never queued as the last will already covers outages
+	c.Client.Publish(c.availabilityTopic, 1, true, payload)
 }
+
+// Close marks our sensors as unavailable and disconnects from the broker.
+func (c *MQTTClient) Close() {
+	c.SetAvailable(false)
+	c.Disconnect(250)
+
+	if c.queue != nil {
+		if err := c.queue.Sync(); err != nil {
+			slog.Error("Failed to sync queue file", slog.Any("error", err))
+		}
+	}
+}
+
+// completedToken is returned for queued messages.
+type completedToken struct{}
+
+func (completedToken) Wait() bool                     { return true }
+func (completedToken) WaitTimeout(time.Duration) bool { return true }
+func (completedToken) Done() <-chan struct{}          { return closedChan }
+func (completedToken) Error() error                   { return nil }
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
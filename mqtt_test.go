@@ -0,0 +1,395 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeClient records published messages and subscriptions of a broker.
+type fakeClient struct {
+	mqtt.Client
+
+	disconnected bool
+
+	// Called for every published message, e.g. to push messages while draining
+	onPublish func(topic string)
+
+	published  []string
+	topics     []string
+	subscribed map[string]mqtt.MessageHandler
+	mutex      sync.Mutex
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return !c.disconnected
+}
+
+func (c *fakeClient) setConnected(connected bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.disconnected = !connected
+
+	// The broker forgets subscriptions of clean sessions
+	c.subscribed = nil
+}
+
+func (c *fakeClient) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	if c.onPublish != nil {
+		c.onPublish(topic)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.topics = append(c.topics, topic)
+
+	switch p := payload.(type) {
+	case []byte:
+		c.published = append(c.published, string(p))
+	case string:
+		c.published = append(c.published, p)
+	}
+
+	return completedToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.subscribed == nil {
+		c.subscribed = map[string]mqtt.MessageHandler{}
+	}
+
+	c.subscribed[topic] = handler
+
+	return completedToken{}
+}
+
+func (c *fakeClient) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.published)
+}
+
+func TestMQTTDrain(t *testing.T) {
+	q, err := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"), 1000, QueuePolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		q.Push(QueuedMessage{Topic: "t", Payload: []byte("queued")})
+	}
+
+	fc := &fakeClient{}
+	c := &MQTTClient{
+		Client: fc,
+		queue:  q,
+	}
+
+	c.drain()
+
+	// Messages published while draining are queued to retain the order
+	for i := 0; i < 100; i++ {
+		c.Publish("t", 0, false, "new")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.count() < 200 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of 200 messages have been published", fc.count())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	waitDrained(t, c)
+
+	// The queue is empty and new messages are published directly
+	c.Publish("t", 0, false, "direct")
+
+	if q.Len() != 0 {
+		t.Errorf("queue still holds %d messages", q.Len())
+	}
+
+	if n := fc.count(); n != 201 {
+		t.Errorf("published %d messages, want 201", n)
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	for i, p := range fc.published {
+		if want := map[bool]string{true: "queued", false: "new"}[i < 100]; i < 200 && p != want {
+			t.Fatalf("message %d is %q, want %q", i, p, want)
+		}
+	}
+}
+
+func waitDrained(t *testing.T, c *MQTTClient) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		c.drainingMutex.Lock()
+		draining := c.draining
+		c.drainingMutex.Unlock()
+
+		if !draining {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("draining did not finish")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Messages which are queued while the head of the queue is being published are not lost.
+func TestMQTTDrainPush(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{QueuePolicyAll, []string{"a=1", "b=1", "c=1"}}, // d=2 is dropped as the queue is full
+		{QueuePolicyLatest, []string{"a=1", "b=1", "c=1", "a=2"}},
+		{QueuePolicyDropOldest, []string{"a=1", "b=1", "c=1", "d=2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			q, err := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"), 3, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, topic := range []string{"a", "b", "c"} {
+				q.Push(QueuedMessage{Topic: topic, Payload: []byte("1")})
+			}
+
+			pushed := false
+			fc := &fakeClient{}
+			fc.onPublish = func(string) {
+				if pushed {
+					return
+				}
+
+				pushed = true
+
+				topic := "d"
+				if tt.policy == QueuePolicyLatest {
+					topic = "a"
+				}
+
+				q.Push(QueuedMessage{Topic: topic, Payload: []byte("2")})
+			}
+
+			c := &MQTTClient{
+				Client: fc,
+				queue:  q,
+			}
+
+			c.drain()
+			waitDrained(t, c)
+
+			fc.mutex.Lock()
+			defer fc.mutex.Unlock()
+
+			got := []string{}
+			for i := range fc.topics {
+				got = append(got, fc.topics[i]+"="+fc.published[i])
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+
+			if q.Len() != 0 {
+				t.Errorf("queue still holds %d messages", q.Len())
+			}
+		})
+	}
+}
+
+// fakeMessage is a received message with a payload only.
+type fakeMessage struct {
+	mqtt.Message
+
+	payload string
+}
+
+func (m fakeMessage) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func (c *fakeClient) hasSubscribed(topic string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.subscribed[topic]
+	return ok
+}
+
+func (c *fakeClient) receive(topic, payload string) {
+	c.mutex.Lock()
+	handler := c.subscribed[topic]
+	c.mutex.Unlock()
+
+	handler(c, fakeMessage{payload: payload})
+}
+
+func resynced(c *MQTTClient) bool {
+	select {
+	case <-c.Resync():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	fc := &fakeClient{disconnected: true}
+	c := &MQTTClient{
+		Client:            fc,
+		resync:            make(chan struct{}, 1),
+		subscriptions:     map[string]subscription{},
+		availabilityTopic: "availability",
+		available:         true,
+	}
+
+	status := hassioMQTTDiscoveryPrefix + "/status"
+
+	// Subscriptions are only recorded while the broker is unreachable
+	if err := c.SubscribeHomeAssistantStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddSubscription("pm/state", 0, func(mqtt.Client, mqtt.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fc.hasSubscribed(status) {
+		t.Error("subscribed while disconnected")
+	}
+
+	for i := 0; i < 2; i++ {
+		fc.setConnected(true)
+		c.onConnect()
+
+		for _, topic := range []string{status, "pm/state"} {
+			if !fc.hasSubscribed(topic) {
+				t.Errorf("connect %d: not subscribed to %s", i, topic)
+			}
+		}
+
+		if !resynced(c) {
+			t.Errorf("connect %d: no resync", i)
+		}
+
+		fc.mutex.Lock()
+		birth := fc.topics[len(fc.topics)-1] == "availability" && fc.published[len(fc.published)-1] == AvailabilityOnline
+		fc.mutex.Unlock()
+
+		if !birth {
+			t.Errorf("connect %d: no birth message", i)
+		}
+
+		fc.setConnected(false)
+	}
+
+	fc.setConnected(true)
+	c.onConnect()
+	resynced(c)
+
+	// Home Assistant restarts
+	tests := []struct {
+		status string
+		resync bool
+	}{
+		{AvailabilityOffline, false},
+		{AvailabilityOnline, true},
+		{AvailabilityOnline, true},
+	}
+
+	for _, tt := range tests {
+		fc.receive(status, tt.status)
+
+		if got := resynced(c); got != tt.resync {
+			t.Errorf("status %s: resync = %v, want %v", tt.status, got, tt.resync)
+		}
+	}
+}
+
+func TestPublisherResync(t *testing.T) {
+	fc := &fakeClient{}
+	c := &MQTTClient{
+		Client: fc,
+	}
+
+	sensors := []Sensor{
+		{ObjectID: "a", Component: ComponentSensor},
+		{ObjectID: "b", Component: ComponentSensor},
+		{ObjectID: "c", Component: ComponentSensor}, // Without a value
+	}
+
+	store := NewStateStore()
+	store.Set(Update{Sensor: &sensors[0], Value: 1}, true)
+	store.Set(Update{Sensor: &sensors[1], Value: 2}, true)
+
+	p := &Publisher{
+		mqtt:       c,
+		store:      store,
+		discovery:  true,
+		discovered: map[*Sensor]bool{},
+	}
+
+	p.Resync()
+
+	want := map[string]string{
+		sensors[0].Topic("state"): "1.00",
+		sensors[1].Topic("state"): "2.00",
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	configs := map[string]bool{}
+	for i, topic := range fc.topics {
+		if v, ok := want[topic]; ok {
+			if fc.published[i] != v {
+				t.Errorf("%s: got %q, want %q", topic, fc.published[i], v)
+			}
+
+			delete(want, topic)
+		} else {
+			configs[topic] = true
+		}
+	}
+
+	if len(want) > 0 {
+		t.Errorf("states have not been resent: %v", want)
+	}
+
+	for _, s := range sensors {
+		if got, want := configs[s.Topic("config")], s.ObjectID != "c"; got != want {
+			t.Errorf("%s: config resent = %v, want %v", s.ObjectID, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"math"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	RejectMin       = "min"
+	RejectMax       = "max"
+	RejectRate      = "rate_of_change"
+	RejectOutlier   = "outlier"
+	RejectDecreased = "decreased"
+)
+
+// reanchorSamples is the number of consecutive non-decreasing values after which
+// a monotonic sensor accepts a drop, e.g. after a garbage frame or a counter reset.
+const reanchorSamples = 3
+
+// Limits are plausibility rules for the decoded values of a sensor.
+type Limits struct {
+	Min             *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max             *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+	MaxRateOfChange float64  `json:"max_rate_of_change,omitempty" yaml:"max_rate_of_change,omitempty"` // Per second
+	Outliers        *Outlier `json:"outliers,omitempty" yaml:"outliers,omitempty"`
+
+	// Monotonic drops decreasing values.
+	// Defaults to true for sensors with a total_increasing state class.
+	Monotonic *bool `json:"monotonic,omitempty" yaml:"monotonic,omitempty"`
+}
+
+// Outlier rejects values which deviate more than Sigma standard deviations from the mean of the last Samples values.
+type Outlier struct {
+	Sigma   float64 `json:"sigma" yaml:"sigma"`
+	Samples int     `json:"samples" yaml:"samples"`
+}
+
+type plausibility struct {
+	*Limits
+
+	monotonic bool
+	wrap      float64 // Range of the raw counter in scaled units or zero if wraparound is not handled
+
+	last   *Update
+	offset float64 // Accumulated wraparounds
+
+	// Monotonic sensors only count a wraparound if the two last accepted raw
+	// values were close to the end of the register range.
+	lastRaw, prevRaw float64
+
+	// Consecutive values rejected as decreased
+	dropped     int
+	lastDropped float64
+
+	window []float64
+	next   int
+}
+
+// Checker rejects implausible values of decoded sensors.
+// Rejected values are counted per sensor and reason in the metrics.
+type Checker struct {
+	sensors map[*Sensor]*plausibility
+}
+
+func NewChecker(sensors []Sensor) *Checker {
+	c := &Checker{
+		sensors: map[*Sensor]*plausibility{},
+	}
+
+	for i := range sensors {
+		s := &sensors[i]
+
+		limits := s.Limits
+		if limits == nil {
+			limits = &Limits{}
+		}
+
+		p := &plausibility{
+			Limits:    limits,
+			monotonic: s.StateClass == StateClassTotalIncreasing,
+		}
+
+		if limits.Monotonic != nil {
+			p.monotonic = *limits.Monotonic
+		}
+
+		if q := s.Quantity; q != nil && p.monotonic && q.Size <= 2 {
+			p.wrap = math.Pow(2, float64(16*q.Size)) * math.Abs(float64(q.Scale))
+		}
+
+		if s.Limits == nil && !p.monotonic {
+			continue
+		}
+
+		c.sensors[s] = p
+	}
+
+	return c
+}
+
+// Check returns false if the update is implausible.
+// For monotonic counters, the returned update accounts for previous wraparounds.
+func (c *Checker) Check(upd Update) (Update, bool) {
+	p, ok := c.sensors[upd.Sensor]
+	if !ok {
+		return upd, true
+	}
+
+	reason := p.check(&upd)
+	if reason == "" {
+		return upd, true
+	}
+
+	id := upd.Sensor.ObjectID
+	count := metrics.ValueRejected(id, reason)
+
+	slog.Warn("Rejected implausible value",
+		slog.String("sensor", id),
+		slog.String("reason", reason),
+		slog.Float64("value", float64(upd.Value)),
+		slog.Uint64("count", count))
+
+	stream.Event("rejected", "Rejected implausible value", id, "reason", reason, "value", upd.Value)
+
+	return upd, false
+}
+
+func (p *plausibility) check(upd *Update) string {
+	v := float64(upd.Value) + p.offset
+
+	if p.Min != nil && v < *p.Min {
+		return RejectMin
+	}
+
+	if p.Max != nil && v > *p.Max {
+		return RejectMax
+	}
+
+	if p.Outliers != nil && p.Outliers.Samples > 1 {
+		isOutlier := p.isOutlier(v)
+
+		// Rejected values are part of the window as well so that it can follow genuine level shifts
+		p.addSample(v)
+
+		if isOutlier {
+			return RejectOutlier
+		}
+	}
+
+	raw := float64(upd.Value)
+
+	if p.last != nil {
+		last := float64(p.last.Value)
+
+		if p.monotonic && v < last {
+			if p.isWraparound(raw) {
+				p.offset += p.wrap
+				v += p.wrap
+			} else if !p.reanchor(v) {
+				return RejectDecreased
+			}
+		} else if p.MaxRateOfChange > 0 {
+			if dt := upd.Time.Sub(p.last.Time).Seconds(); dt > 0 && math.Abs(v-last)/dt > p.MaxRateOfChange {
+				return RejectRate
+			}
+		}
+	}
+
+	upd.Value = float32(v)
+	p.last = upd
+	p.prevRaw, p.lastRaw = p.lastRaw, raw
+	p.dropped = 0
+
+	return ""
+}
+
+// isWraparound checks if a drop of a monotonic counter to raw is caused by a wraparound.
+// A single garbage frame close to the end of the register range does not suffice.
+func (p *plausibility) isWraparound(raw float64) bool {
+	if p.wrap == 0 {
+		return false
+	}
+
+	top := p.wrap * 3 / 4
+
+	return p.lastRaw > top && p.prevRaw > top && raw < p.wrap/4
+}
+
+// reanchor checks if a monotonic sensor should accept a drop to v.
+// This is the case after reanchorSamples consecutive drops which do not decrease among each other.
+// Otherwise, a single implausibly high value would block all further values.
+func (p *plausibility) reanchor(v float64) bool {
+	if p.dropped > 0 && v >= p.lastDropped {
+		p.dropped++
+	} else {
+		p.dropped = 1
+	}
+
+	p.lastDropped = v
+
+	return p.dropped >= reanchorSamples
+}
+
+func (p *plausibility) isOutlier(v float64) bool {
+	if len(p.window) < p.Outliers.Samples {
+		return false
+	}
+
+	var sum, sumSq float64
+	for _, w := range p.window {
+		sum += w
+	}
+
+	mean := sum / float64(len(p.window))
+
+	for _, w := range p.window {
+		sumSq += (w - mean) * (w - mean)
+	}
+
+	stddev := math.Sqrt(sumSq / float64(len(p.window)))
+	if stddev == 0 {
+		return false
+	}
+
+	return math.Abs(v-mean) > p.Outliers.Sigma*stddev
+}
+
+func (p *plausibility) addSample(v float64) {
+	if len(p.window) < p.Outliers.Samples {
+		p.window = append(p.window, v)
+		return
+	}
+
+	p.window[p.next] = v
+	p.next = (p.next + 1) % len(p.window)
+}
@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type checkStep struct {
+	value float32
+	ok    bool
+	want  float32 // Value after accounting for wraparounds
+}
+
+func runChecks(t *testing.T, s Sensor, steps []checkStep) {
+	t.Helper()
+
+	sensors := []Sensor{s}
+	c := NewChecker(sensors)
+	ts := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	for i, st := range steps {
+		upd, ok := c.Check(Update{
+			Sensor: &sensors[0],
+			Value:  st.value,
+			Time:   ts.Add(time.Duration(i) * time.Second),
+		})
+
+		if ok != st.ok {
+			t.Errorf("step %d: accepted = %v, want %v", i, ok, st.ok)
+		} else if ok && math.Abs(float64(upd.Value-st.want)) > 1e-3*math.Abs(float64(st.want)) {
+			t.Errorf("step %d: value = %v, want %v", i, upd.Value, st.want)
+		}
+	}
+}
+
+func TestCheckerWraparound16(t *testing.T) {
+	runChecks(t, Sensor{
+		ObjectID:   "counter",
+		StateClass: StateClassTotalIncreasing,
+		Quantity:   &Quantity{Size: 1, Scale: 1},
+	}, []checkStep{
+		{65530, true, 65530},
+		{65535, true, 65535},
+		{3, true, 65539},
+		{2, false, 0}, // Decreased
+		{100, true, 65636},
+		{65000, true, 130536},
+		{65500, true, 131036},
+		{50, true, 131122},
+	})
+}
+
+func TestCheckerSpike(t *testing.T) {
+	counter := Sensor{
+		ObjectID:   "counter",
+		StateClass: StateClassTotalIncreasing,
+		Quantity:   &Quantity{Size: 1, Scale: 1},
+	}
+
+	tests := []struct {
+		name  string
+		steps []checkStep
+	}{
+		{"spike then genuine", []checkStep{
+			{100, true, 100},
+			{101, true, 101},
+			{60000, true, 60000}, // Garbage frame
+			{102, false, 0},
+			{103, false, 0},
+			{104, true, 104}, // Re-anchored
+			{105, true, 105},
+		}},
+		{"wraparound", []checkStep{
+			{65000, true, 65000},
+			{65535, true, 65535},
+			{100, true, 65636},
+		}},
+		{"single value close to the end", []checkStep{
+			{100, true, 100},
+			{65535, true, 65535}, // Garbage frame
+			{101, false, 0},      // Not handled as a wraparound
+			{102, false, 0},
+			{103, true, 103},
+		}},
+		{"inconsistent drops", []checkStep{
+			{1000, true, 1000},
+			{500, false, 0},
+			{400, false, 0}, // Decreases among the drops
+			{450, false, 0},
+			{460, true, 460},
+		}},
+		{"drop followed by genuine values", []checkStep{
+			{1000, true, 1000},
+			{10, false, 0},
+			{1001, true, 1001},
+			{20, false, 0},
+			{30, false, 0},
+			{1002, true, 1002},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runChecks(t, counter, tt.steps)
+		})
+	}
+
+	// With a rate limit, the garbage frame is not accepted in the first place
+	counter.Limits = &Limits{MaxRateOfChange: 10}
+
+	runChecks(t, counter, []checkStep{
+		{100, true, 100},
+		{60000, false, 0},
+		{101, true, 101},
+		{102, true, 102},
+	})
+}
+
+func TestCheckerWraparound32(t *testing.T) {
+	runChecks(t, Sensor{
+		ObjectID:   "energy",
+		StateClass: StateClassTotalIncreasing,
+		Quantity:   &Quantity{Size: 2, Scale: 0.001},
+	}, []checkStep{
+		{4294960, true, 4294960},
+		{4294967, true, 4294967},
+		{5, true, 4294972.296},
+		{6, true, 4294973.296},
+		{1000, true, 4295967.296},
+		{500, false, 0},
+	})
+}
+
+func TestCheckerLimits(t *testing.T) {
+	min, max := -10.0, 100.0
+	monotonic := false
+
+	runChecks(t, Sensor{
+		ObjectID: "power",
+		Limits: &Limits{
+			Min:             &min,
+			Max:             &max,
+			MaxRateOfChange: 50,
+			Monotonic:       &monotonic,
+		},
+	}, []checkStep{
+		{10, true, 10},
+		{70, false, 0}, // 60 per second
+		{50, true, 50}, // 20 per second
+		{-11, false, 0},
+		{101, false, 0},
+		{0, true, 0},
+	})
+}
+
+func TestCheckerOutliers(t *testing.T) {
+	monotonic := false
+
+	runChecks(t, Sensor{
+		ObjectID: "voltage",
+		Limits: &Limits{
+			Outliers:  &Outlier{Sigma: 3, Samples: 4},
+			Monotonic: &monotonic,
+		},
+	}, []checkStep{
+		{230, true, 230},
+		{231, true, 231},
+		{229, true, 229},
+		{230, true, 230},
+		{500, false, 0},
+		{231, true, 231},
+	})
+}
+
+func TestCheckerUnchecked(t *testing.T) {
+	runChecks(t, Sensor{
+		ObjectID: "temperature",
+	}, []checkStep{
+		{20, true, 20},
+		{-40, true, -40},
+	})
+}
@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"golang.org/x/exp/slog"
+)
+
+// Publisher passes new sensor values to the state store and MQTT.
+// Other outputs receive the values by subscribing to the store.
+// Values held back by the publish settings only reach the store subscribers
+// registered with SubscribeAll.
+//
+// The MQTT discovery config of a sensor is sent along with its first value.
+// This way, only the instance which actually produces a sensor announces it
+// and references its own availability topic.
+type Publisher struct {
+	mqtt      *MQTTClient
+	store     *StateStore
+	throttler *Throttler
+
+	discovery  bool
+	discovered map[*Sensor]bool
+	tracker    *DiscoveryTracker
+
+	// Only used if states are published per device
+	device *DeviceState
+}
+
+func (p *Publisher) Publish(upd Update) {
+	allowed := p.throttler == nil || p.throttler.Allow(upd)
+
+	p.store.Set(upd, allowed)
+
+	if !allowed {
+		return
+	}
+
+	sensor := upd.Sensor
+
+	if p.mqtt != nil {
+		if p.discovery && !p.discovered[sensor] {
+			if err := sensor.SendConfig(p.mqtt); err != nil {
+				slog.Error("Failed to send MQTT discovery config", slog.String("id", sensor.ObjectID), slog.Any("error", err))
+			} else {
+				slog.Info("Send MQTT discovery config", slog.String("id", sensor.ObjectID))
+				p.discovered[sensor] = true
+
+				if p.tracker != nil {
+					p.tracker.Add(sensor.Topic("config"))
+				}
+			}
+		}
+
+		if p.device != nil {
+			p.device.Update(upd)
+		} else {
+			sensor.SendState(p.mqtt, upd)
+		}
+	}
+}
+
+// Flush publishes the values collected during a poll cycle if states are published per device.
+func (p *Publisher) Flush() {
+	if p.mqtt == nil || p.device == nil {
+		return
+	}
+
+	p.device.Flush(p.mqtt)
+}
+
+// Rediscover resends the discovery configs of all published sensors of a device after its metadata changed.
+func (p *Publisher) Rediscover(dev *Device) {
+	if p.mqtt == nil || !p.discovery {
+		return
+	}
+
+	for sensor := range p.discovered {
+		if sensor.Device != dev {
+			continue
+		}
+
+		if err := sensor.SendConfig(p.mqtt); err != nil {
+			slog.Error("Failed to send MQTT discovery config", slog.String("id", sensor.ObjectID), slog.Any("error", err))
+		}
+	}
+}
+
+// Resync resends the discovery configs and last states of all sensors.
+// This is required after Home Assistant or the broker have been restarted.
+func (p *Publisher) Resync() {
+	if p.mqtt == nil {
+		return
+	}
+
+	snap := p.store.Snapshot()
+
+	slog.Info("Resending discovery configs and states", slog.Int("count", len(snap.Values)))
+
+	for sensor, v := range snap.Values {
+		upd := v.Update
+
+		if p.discovery {
+			if err := sensor.SendConfig(p.mqtt); err != nil {
+				slog.Error("Failed to send MQTT discovery config", slog.String("id", sensor.ObjectID), slog.Any("error", err))
+			}
+		}
+
+		if p.device == nil {
+			sensor.SendState(p.mqtt, upd)
+		}
+	}
+
+	if p.device != nil {
+		p.device.Send(p.mqtt)
+	}
+}
@@ -17,6 +17,8 @@ type Quantity struct {
 	Size     int     `json:"size" yaml:"size"`
 	Scale    float32 `json:"scale" yaml:"scale"`
 	Offset   float32 `json:"offset,omitempty" yaml:"offset,omitempty"`
+
+	filter Filter
 }
 
 func (q *Quantity) Decode(regs []uint16) (Result, error) {
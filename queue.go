@@ -0,0 +1,277 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	QueuePolicyAll        = "all"         // Keep all messages and drop new ones if the queue is full
+	QueuePolicyLatest     = "latest"      // Keep only the latest message per topic
+	QueuePolicyDropOldest = "drop-oldest" // Drop the oldest message if the queue is full
+)
+
+// QueuedMessage is an MQTT message which could not be published yet.
+type QueuedMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Payload  []byte    `json:"payload"`
+	Time     time.Time `json:"time"`
+
+	seq uint64 // Identifies the message while it is queued
+}
+
+// Queue is a bounded, disk-backed FIFO of outbound MQTT messages.
+//
+// New messages are appended to the queue file. The file is rewritten
+// after the queue has been drained or when it contains too many stale
+// entries. When loading the file, the policy is applied again so that
+// the result matches the in-memory queue.
+type Queue struct {
+	fn     string
+	size   int
+	policy string
+
+	messages []QueuedMessage
+	lines    int    // Number of entries in the queue file
+	seq      uint64 // Sequence number of the last added message
+
+	queued  uint64
+	dropped uint64
+
+	mutex sync.Mutex
+}
+
+func NewQueue(fn string, size int, policy string) (*Queue, error) {
+	switch policy {
+	case QueuePolicyAll, QueuePolicyLatest, QueuePolicyDropOldest:
+	default:
+		return nil, fmt.Errorf("invalid queue policy: %s", policy)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		fn:     fn,
+		size:   size,
+		policy: policy,
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	f, err := os.Open(q.fn)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		var m QueuedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			slog.Warn("Skipping invalid entry in queue file", slog.String("file", q.fn), slog.Any("error", err))
+			continue
+		}
+
+		q.add(m)
+		q.lines++
+	}
+
+	if len(q.messages) > 0 {
+		slog.Info("Loaded queued MQTT messages", slog.Int("count", len(q.messages)))
+	}
+
+	return scanner.Err()
+}
+
+// Push adds a message to the end of the queue.
+func (q *Queue) Push(m QueuedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.queued++
+
+	if !q.add(m) {
+		return
+	}
+
+	if err := q.append(m); err != nil {
+		slog.Error("Failed to write queue file", slog.Any("error", err))
+	}
+
+	if q.lines > 2*q.size {
+		if err := q.compact(); err != nil {
+			slog.Error("Failed to compact queue file", slog.Any("error", err))
+		}
+	}
+}
+
+// add applies the policy and returns false if the message has been dropped.
+func (q *Queue) add(m QueuedMessage) bool {
+	q.seq++
+	m.seq = q.seq
+
+	if q.policy == QueuePolicyLatest {
+		for i, n := range q.messages {
+			if n.Topic == m.Topic {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(q.messages) >= q.size {
+		if q.policy == QueuePolicyAll {
+			q.drop(m)
+			return false
+		}
+
+		q.drop(q.messages[0])
+		q.messages = q.messages[1:]
+	}
+
+	q.messages = append(q.messages, m)
+
+	return true
+}
+
+func (q *Queue) drop(m QueuedMessage) {
+	q.dropped++
+
+	slog.Warn("Dropped queued MQTT message", slog.String("topic", m.Topic), slog.Uint64("dropped", q.dropped))
+}
+
+// Peek returns the oldest message without removing it.
+// The message is removed by passing it to Pop after it has been published.
+func (q *Queue) Peek() (QueuedMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.messages) == 0 {
+		return QueuedMessage{}, false
+	}
+
+	return q.messages[0], true
+}
+
+// Pop removes a message returned by Peek.
+// Messages pushed in the meantime might have replaced or dropped it already.
+// Then, the queue is left unchanged.
+func (q *Queue) Pop(m QueuedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, n := range q.messages {
+		if n.seq == m.seq {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.messages)
+}
+
+// Stats returns the number of queued and dropped messages since the start.
+func (q *Queue) Stats() (queued, dropped uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.queued, q.dropped
+}
+
+// Sync rewrites the queue file with the remaining messages.
+func (q *Queue) Sync() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.compact()
+}
+
+func (q *Queue) append(m QueuedMessage) error {
+	f, err := os.OpenFile(q.fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(&m); err != nil {
+		f.Close()
+		return err
+	}
+
+	q.lines++
+
+	return f.Close()
+}
+
+func (q *Queue) compact() error {
+	if len(q.messages) == 0 {
+		q.lines = 0
+
+		if err := os.Remove(q.fn); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	tmp := q.fn + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for i := range q.messages {
+		if err := enc.Encode(&q.messages[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	q.lines = len(q.messages)
+
+	return os.Rename(tmp, q.fn)
+}
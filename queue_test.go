@@ -0,0 +1,244 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func queueTopics(q *Queue) []string {
+	topics := []string{}
+	for _, m := range q.messages {
+		topics = append(topics, m.Topic+"="+string(m.Payload))
+	}
+
+	return topics
+}
+
+func queueFileLines(t *testing.T, fn string) int {
+	t.Helper()
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); {
+		n++
+	}
+
+	return n
+}
+
+func TestQueuePolicies(t *testing.T) {
+	pushes := []QueuedMessage{
+		{Topic: "a", Payload: []byte("1")},
+		{Topic: "b", Payload: []byte("1")},
+		{Topic: "a", Payload: []byte("2")},
+		{Topic: "c", Payload: []byte("1")},
+		{Topic: "d", Payload: []byte("1")},
+	}
+
+	tests := []struct {
+		policy  string
+		want    []string
+		dropped uint64
+	}{
+		{QueuePolicyAll, []string{"a=1", "b=1", "a=2"}, 2},
+		{QueuePolicyDropOldest, []string{"a=2", "c=1", "d=1"}, 2},
+		{QueuePolicyLatest, []string{"a=2", "c=1", "d=1"}, 1},
+	}
+
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), "queue.jsonl")
+
+		q, err := NewQueue(fn, 3, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range pushes {
+			q.Push(m)
+		}
+
+		if got := queueTopics(q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: queue = %v, want %v", tt.policy, got, tt.want)
+		}
+
+		if queued, dropped := q.Stats(); queued != uint64(len(pushes)) || dropped != tt.dropped {
+			t.Errorf("%s: stats = %d queued, %d dropped, want %d, %d", tt.policy, queued, dropped, len(pushes), tt.dropped)
+		}
+
+		// The policy is applied again when loading the file
+		r, err := NewQueue(fn, 3, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := queueTopics(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loaded queue = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+
+	if _, err := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"), 3, "newest"); err == nil {
+		t.Error("expected error for invalid policy")
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "queue.jsonl")
+
+	q, err := NewQueue(fn, 10, QueuePolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := q.Peek(); ok {
+		t.Fatal("empty queue returned a message")
+	}
+
+	for _, p := range []string{"1", "2", "3"} {
+		q.Push(QueuedMessage{Topic: "t", Payload: []byte(p)})
+	}
+
+	m, ok := q.Peek()
+	if !ok || string(m.Payload) != "1" {
+		t.Fatalf("peek = %v, %v", m, ok)
+	}
+
+	q.Pop(m)
+	q.Pop(m) // Popping a removed message is a no-op
+
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := queueFileLines(t, fn); n != 2 {
+		t.Errorf("queue file has %d lines, want 2", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		m, _ := q.Peek()
+		q.Pop(m)
+	}
+
+	q.Pop(m) // Popping an empty queue is a no-op
+
+	if q.Len() != 0 {
+		t.Errorf("queue length = %d, want 0", q.Len())
+	}
+
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Error("queue file has not been removed after draining")
+	}
+}
+
+// Messages are pushed while the head of the queue is being published.
+func TestQueuePushWhileDraining(t *testing.T) {
+	tests := []struct {
+		policy string
+		push   []string // Topics pushed after peeking the head
+		want   []string // Queue after popping the head
+	}{
+		// The full queue drops the new message, not the head
+		{QueuePolicyAll, []string{"a", "d"}, []string{"b=1", "c=1"}},
+
+		// The head is replaced by a newer message of the same topic
+		{QueuePolicyLatest, []string{"a"}, []string{"b=1", "c=1", "a=2"}},
+		{QueuePolicyLatest, []string{"a", "b"}, []string{"c=1", "a=2", "b=2"}},
+
+		// The head is dropped as the queue is full
+		{QueuePolicyDropOldest, []string{"d"}, []string{"b=1", "c=1", "d=2"}},
+		{QueuePolicyDropOldest, []string{"d", "e"}, []string{"c=1", "d=2", "e=2"}},
+	}
+
+	for _, tt := range tests {
+		q, err := NewQueue(filepath.Join(t.TempDir(), "queue.jsonl"), 3, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, topic := range []string{"a", "b", "c"} {
+			q.Push(QueuedMessage{Topic: topic, Payload: []byte("1")})
+		}
+
+		head, ok := q.Peek()
+		if !ok || head.Topic != "a" {
+			t.Fatalf("%s: peek = %v, %v", tt.policy, head, ok)
+		}
+
+		for _, topic := range tt.push {
+			q.Push(QueuedMessage{Topic: topic, Payload: []byte("2")})
+		}
+
+		q.Pop(head)
+
+		if got := queueTopics(q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: queue = %v, want %v", tt.policy, tt.push, got, tt.want)
+		}
+	}
+}
+
+func TestQueueCompaction(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "queue.jsonl")
+
+	q, err := NewQueue(fn, 2, QueuePolicyLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced messages remain in the file until it is compacted
+	for i := 0; i < 4; i++ {
+		q.Push(QueuedMessage{Topic: "t", Payload: []byte{byte('0' + i)}})
+	}
+
+	if n := queueFileLines(t, fn); n != 4 {
+		t.Errorf("queue file has %d lines, want 4", n)
+	}
+
+	// Exceeding twice the size compacts the file
+	q.Push(QueuedMessage{Topic: "t", Payload: []byte("4")})
+
+	if n := queueFileLines(t, fn); n != 1 {
+		t.Errorf("queue file has %d lines after compaction, want 1", n)
+	}
+
+	r, err := NewQueue(fn, 2, QueuePolicyLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := queueTopics(r), []string{"t=4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded queue = %v, want %v", got, want)
+	}
+}
+
+func TestQueueInvalidEntries(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "queue.jsonl")
+
+	if err := os.WriteFile(fn, []byte("{\"topic\":\"a\",\"payload\":\"MQ==\"}\ninvalid\n{\"topic\":\"b\",\"payload\":\"Mg==\"}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQueue(fn, 10, QueuePolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := queueTopics(q), []string{"a=1", "b=2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+}
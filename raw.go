@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/exp/slog"
+)
+
+const DefaultRawTopic = "modbus-sniffer/raw"
+
+// Raw configures the publishing of raw transactions to MQTT.
+type Raw struct {
+	Topic  string      `yaml:"topic,omitempty"`
+	QoS    byte        `yaml:"qos,omitempty"`
+	Retain bool        `yaml:"retain,omitempty"`
+	Filter *FilterRule `yaml:"filter,omitempty"`
+}
+
+// topic returns the topic of a transaction:
+//
+//	<topic>/<unit>/<function code>/<address>
+func (r *Raw) topic(t *Transaction) string {
+	prefix := r.Topic
+	if prefix == "" {
+		prefix = DefaultRawTopic
+	}
+
+	return fmt.Sprintf("%s/%d/%d/%d", prefix, t.Unit, t.FunctionCode, t.Address)
+}
+
+// Publish sends a transaction to MQTT if it matches the filter.
+func (r *Raw) Publish(c *MQTTClient, t *Transaction) {
+	if r.Filter != nil && !t.Filter(r.Filter) {
+		return
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		slog.Error("Failed to marshal transaction", slog.Any("error", err))
+		return
+	}
+
+	c.Publish(r.topic(t), r.QoS, r.Retain, payload)
+}
@@ -0,0 +1,302 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// RegisterTableHolding is the only table decoded so far.
+// Input registers (function code 4) are not parsed by the decoder.
+const RegisterTableHolding = "holding"
+
+type registerKey struct {
+	unit    byte
+	table   string
+	address uint16
+}
+
+type rangeKey struct {
+	unit         byte
+	table        string
+	start, count uint16
+}
+
+// RegisterValue is the last observed value of a register.
+type RegisterValue struct {
+	Address uint16     `json:"address"`
+	Value   *uint16    `json:"value"` // Nil if the register has not been observed yet
+	Time    *time.Time `json:"time,omitempty"`
+	Updates uint64     `json:"updates"`
+}
+
+func (v *RegisterValue) copy() RegisterValue {
+	r := *v.Value
+	t := *v.Time
+
+	return RegisterValue{
+		Address: v.Address,
+		Value:   &r,
+		Time:    &t,
+		Updates: v.Updates,
+	}
+}
+
+// PolledRange is a range of registers which is read by the master.
+type PolledRange struct {
+	Unit     byte          `json:"unit"`
+	Table    string        `json:"table"`
+	Start    uint16        `json:"start"`
+	Count    uint16        `json:"count"`
+	Polls    uint64        `json:"polls"`
+	LastPoll time.Time     `json:"last_poll"`
+	Interval time.Duration `json:"-"`
+
+	IntervalSeconds float64 `json:"interval"` // Smoothed time between polls
+}
+
+// RegisterImage holds the last observed value of every register per unit and table.
+//
+// It is updated by the main loop and read concurrently by the HTTP handlers.
+type RegisterImage struct {
+	registers map[registerKey]*RegisterValue
+	ranges    map[rangeKey]*PolledRange
+	last      *Transaction
+
+	mutex sync.RWMutex
+}
+
+var registerImage = NewRegisterImage()
+
+func NewRegisterImage() *RegisterImage {
+	return &RegisterImage{
+		registers: map[registerKey]*RegisterValue{},
+		ranges:    map[rangeKey]*PolledRange{},
+	}
+}
+
+// Update stores the registers of an accepted transaction.
+func (ri *RegisterImage) Update(t *Transaction) {
+	if t == nil {
+		return
+	}
+
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	ri.last = t
+
+	for i, r := range t.Registers {
+		k := registerKey{t.Unit, RegisterTableHolding, t.Address + uint16(i)}
+
+		v, ok := ri.registers[k]
+		if !ok {
+			v = &RegisterValue{
+				Address: k.address,
+				Value:   new(uint16),
+				Time:    new(time.Time),
+			}
+			ri.registers[k] = v
+		}
+
+		*v.Value = r
+		*v.Time = t.Time
+		v.Updates++
+	}
+}
+
+// Poll records a request of the master, regardless of whether its response is accepted.
+func (ri *RegisterImage) Poll(r *ReadHoldingRegistersRequest, t time.Time) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	rk := rangeKey{r.Unit, RegisterTableHolding, r.Address, r.RegisterCount}
+
+	pr, ok := ri.ranges[rk]
+	if !ok {
+		pr = &PolledRange{
+			Unit:  r.Unit,
+			Table: RegisterTableHolding,
+			Start: r.Address,
+			Count: r.RegisterCount,
+		}
+		ri.ranges[rk] = pr
+	} else if dt := t.Sub(pr.LastPoll); dt > 0 {
+		if pr.Interval == 0 {
+			pr.Interval = dt
+		} else {
+			pr.Interval = (4*pr.Interval + dt) / 5
+		}
+	}
+
+	pr.Polls++
+	pr.LastPoll = t
+}
+
+// Last returns the last accepted transaction.
+func (ri *RegisterImage) Last() *Transaction {
+	ri.mutex.RLock()
+	defer ri.mutex.RUnlock()
+
+	return ri.last
+}
+
+// Registers returns the values of count registers starting at start.
+func (ri *RegisterImage) Registers(unit byte, table string, start uint16, count int) []RegisterValue {
+	ri.mutex.RLock()
+	defer ri.mutex.RUnlock()
+
+	values := []RegisterValue{}
+
+	for i := 0; i < count; i++ {
+		addr := start + uint16(i)
+
+		if v, ok := ri.registers[registerKey{unit, table, addr}]; ok {
+			values = append(values, v.copy())
+		} else {
+			values = append(values, RegisterValue{
+				Address: addr,
+			})
+		}
+	}
+
+	return values
+}
+
+// Observed returns the values of all observed registers of a unit and table.
+func (ri *RegisterImage) Observed(unit byte, table string) []RegisterValue {
+	ri.mutex.RLock()
+	defer ri.mutex.RUnlock()
+
+	values := []RegisterValue{}
+	for k, v := range ri.registers {
+		if k.unit == unit && k.table == table {
+			values = append(values, v.copy())
+		}
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Address < values[j].Address
+	})
+
+	return values
+}
+
+// Ranges returns the polled ranges ordered by unit, table and start address.
+func (ri *RegisterImage) Ranges() []PolledRange {
+	ri.mutex.RLock()
+	defer ri.mutex.RUnlock()
+
+	ranges := []PolledRange{}
+	for _, pr := range ri.ranges {
+		r := *pr
+		r.IntervalSeconds = r.Interval.Seconds()
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.Unit != b.Unit {
+			return a.Unit < b.Unit
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		}
+		return a.Count < b.Count
+	})
+
+	return ranges
+}
+
+type ResponseRegisters struct {
+	Unit      byte            `json:"unit"`
+	Table     string          `json:"table"`
+	Registers []RegisterValue `json:"registers"`
+}
+
+func httpHandleApiRegisters(w http.ResponseWriter, req *http.Request) {
+	unit, err := strconv.ParseUint(req.PathValue("unit"), 0, 8)
+	if err != nil {
+		http.Error(w, "invalid unit", http.StatusBadRequest)
+		return
+	}
+
+	q := req.URL.Query()
+
+	resp := ResponseRegisters{
+		Unit:  byte(unit),
+		Table: RegisterTableHolding,
+	}
+
+	switch t := q.Get("table"); t {
+	case "", RegisterTableHolding:
+	default:
+		http.Error(w, fmt.Sprintf("invalid table: %s", t), http.StatusBadRequest)
+		return
+	}
+
+	if s := q.Get("start"); s == "" {
+		resp.Registers = registerImage.Observed(resp.Unit, resp.Table)
+	} else {
+		start, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			http.Error(w, "invalid start address", http.StatusBadRequest)
+			return
+		}
+
+		count := uint64(1)
+		if c := q.Get("count"); c != "" {
+			if count, err = strconv.ParseUint(c, 0, 32); err != nil || count == 0 || start+count > 1<<16 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp.Registers = registerImage.Registers(resp.Unit, resp.Table, uint16(start), int(count))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		slog.Error("Failed to write response", slog.Any("error", err))
+	}
+}
+
+func httpHandleApiRanges(w http.ResponseWriter, req *http.Request) {
+	ranges := registerImage.Ranges()
+
+	if u := req.URL.Query().Get("unit"); u != "" {
+		unit, err := strconv.ParseUint(u, 0, 8)
+		if err != nil {
+			http.Error(w, "invalid unit", http.StatusBadRequest)
+			return
+		}
+
+		filtered := []PolledRange{}
+		for _, r := range ranges {
+			if r.Unit == byte(unit) {
+				filtered = append(filtered, r)
+			}
+		}
+
+		ranges = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(ranges); err != nil {
+		slog.Error("Failed to write response", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// statePath returns the path of a state file.
+// The file name is prefixed with the MQTT client ID as multiple sniffer instances might share the same directory.
+func statePath(fn string) string {
+	return filepath.Join(stateDir, fmt.Sprintf("%s.%s", mqttOpts.ClientID, fn))
+}
+
+// loadState reads a state file.
+// A missing file is not considered an error.
+func loadState(name string, v any) error {
+	f, err := os.Open(statePath(name + ".json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// saveState atomically replaces a state file.
+func saveState(name string, v any) error {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return err
+	}
+
+	fn := statePath(name + ".json")
+
+	f, err := os.CreateTemp(stateDir, filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// StateValue is the last value of a sensor.
+type StateValue struct {
+	Update
+
+	// Number of values received since startup
+	Updates uint64
+}
+
+// StateSnapshot is a consistent copy of all values in the store.
+type StateSnapshot struct {
+	Time   time.Time              // Time of the newest value
+	Values map[*Sensor]StateValue // Keyed by the configured sensor
+}
+
+type stateSubscription struct {
+	fn  func(Update)
+	all bool // Also receive values held back by the publish settings
+}
+
+// StateStore holds the last published value of every sensor.
+//
+// Values are set by the main loop only, but can be read from any goroutine.
+// Subscribers are called synchronously for every new value in the order in
+// which the values were set. They must not block as they delay the decoding
+// of captured messages.
+//
+// Values which have been held back by the publish settings are only passed
+// to the subscribers registered with SubscribeAll.
+//
+// The main loop keeps changing the sensors and devices, e.g. when the device
+// info is updated. Hence, stored and passed values reference a copy of the
+// sensor and its device which must not be modified.
+type StateStore struct {
+	values map[*Sensor]*StateValue
+	latest time.Time
+
+	subscriptions []*stateSubscription
+
+	mutex            sync.RWMutex
+	subscribersMutex sync.Mutex
+}
+
+var stateStore = NewStateStore()
+
+func NewStateStore() *StateStore {
+	return &StateStore{
+		values: map[*Sensor]*StateValue{},
+	}
+}
+
+// Set passes a new value to the subscribers and stores it if it has been published.
+func (s *StateStore) Set(upd Update, published bool) {
+	key := upd.Sensor
+	upd.Sensor = upd.Sensor.clone()
+
+	if published {
+		s.store(key, upd)
+	}
+
+	// Subscribers are called without holding the lock so that they can read the store
+	s.subscribersMutex.Lock()
+	subs := s.subscriptions
+	s.subscribersMutex.Unlock()
+
+	for _, sub := range subs {
+		if published || sub.all {
+			sub.fn(upd)
+		}
+	}
+}
+
+func (s *StateStore) store(key *Sensor, upd Update) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v, ok := s.values[key]
+	if !ok {
+		v = &StateValue{}
+		s.values[key] = v
+	}
+
+	v.Update = upd
+	v.Updates++
+
+	if upd.Time.After(s.latest) {
+		s.latest = upd.Time
+	}
+}
+
+// Get returns the last value of a sensor.
+func (s *StateStore) Get(sensor *Sensor) (StateValue, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	v, ok := s.values[sensor]
+	if !ok {
+		return StateValue{}, false
+	}
+
+	return *v, true
+}
+
+// Snapshot returns a copy of all values.
+func (s *StateStore) Snapshot() StateSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snap := StateSnapshot{
+		Time:   s.latest,
+		Values: make(map[*Sensor]StateValue, len(s.values)),
+	}
+
+	for sensor, v := range s.values {
+		snap.Values[sensor] = *v
+	}
+
+	return snap
+}
+
+// Subscribe registers a function which is called for every published value.
+// The returned function cancels the subscription.
+func (s *StateStore) Subscribe(fn func(Update)) func() {
+	return s.subscribe(&stateSubscription{
+		fn: fn,
+	})
+}
+
+// SubscribeAll registers a function which is called for every new value
+// regardless of the publish settings.
+// The returned function cancels the subscription.
+func (s *StateStore) SubscribeAll(fn func(Update)) func() {
+	return s.subscribe(&stateSubscription{
+		fn:  fn,
+		all: true,
+	})
+}
+
+func (s *StateStore) subscribe(sub *stateSubscription) func() {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	// Copy on write as Set iterates over the subscriptions without holding the lock
+	s.subscriptions = append(s.subscriptions[:len(s.subscriptions):len(s.subscriptions)], sub)
+
+	return func() {
+		s.subscribersMutex.Lock()
+		defer s.subscribersMutex.Unlock()
+
+		subs := []*stateSubscription{}
+		for _, t := range s.subscriptions {
+			if t != sub {
+				subs = append(subs, t)
+			}
+		}
+
+		s.subscriptions = subs
+	}
+}
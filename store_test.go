@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateStoreSet(t *testing.T) {
+	s := NewStateStore()
+	sensor := &Sensor{ObjectID: "a"}
+
+	var published, all int
+	s.Subscribe(func(Update) { published++ })
+	s.SubscribeAll(func(Update) { all++ })
+
+	s.Set(Update{Sensor: sensor, Value: 1}, true)
+	s.Set(Update{Sensor: sensor, Value: 2}, false)
+
+	v, ok := s.Get(sensor)
+	if !ok || v.Value != 1 || v.Updates != 1 {
+		t.Errorf("got %v (%d updates), want last published value 1", v.Value, v.Updates)
+	}
+
+	if published != 1 || all != 2 {
+		t.Errorf("got %d published and %d total values, want 1 and 2", published, all)
+	}
+}
+
+// The main loop changes the device info while the HTTP handlers read the store.
+func TestStateStoreCopiesSensor(t *testing.T) {
+	s := NewStateStore()
+	sensor := &Sensor{ObjectID: "a", Device: &Device{Name: "dev"}}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			for _, v := range s.Snapshot().Values {
+				if _, err := json.Marshal(v.Sensor); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		sensor.Device.SoftwareVersion = fmt.Sprint(i)
+		s.Set(Update{Sensor: sensor, Value: float32(i), Time: time.Now()}, true)
+	}
+
+	close(done)
+	wg.Wait()
+
+	v, _ := s.Get(sensor)
+	if v.Sensor == sensor || v.Sensor.Device == sensor.Device {
+		t.Error("store references the configured sensor")
+	}
+
+	if got := v.Sensor.Device.SoftwareVersion; got != "999" {
+		t.Errorf("got software version %q, want 999", got)
+	}
+}
@@ -0,0 +1,450 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	StreamTypeUpdate      = "update"
+	StreamTypeTransaction = "transaction"
+	StreamTypeEvent       = "event"
+
+	// Number of messages buffered per client before messages are dropped
+	streamBufferSize = 256
+
+	streamKeepAlive = 15 * time.Second
+)
+
+// StreamMessage is pushed to the clients of the stream endpoint.
+type StreamMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// StreamUpdate is a new sensor value.
+type StreamUpdate struct {
+	Time              time.Time `json:"time"`
+	Sensor            string    `json:"sensor"`
+	Name              string    `json:"name,omitempty"`
+	Value             float32   `json:"value"`
+	UnitOfMeasurement string    `json:"unit_of_measurement,omitempty"`
+	Register          *uint16   `json:"register,omitempty"`
+	Raw               []uint16  `json:"raw,omitempty"`
+}
+
+// StreamEvent is a noteworthy change of the state of the sniffer.
+type StreamEvent struct {
+	Time    time.Time      `json:"time"`
+	Kind    string         `json:"kind"`
+	Message string         `json:"message"`
+	Sensor  string         `json:"sensor,omitempty"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// streamItem carries the attributes used for filtering along with the data.
+type streamItem struct {
+	typ    string
+	sensor string
+	unit   int // -1 if not applicable
+	start  int // First register, -1 if not applicable
+	end    int // Last register
+	data   any
+}
+
+// StreamFilter selects the messages a client receives.
+//
+// Each criterion only applies to the messages which carry the respective
+// attribute. For example, a unit filter does not affect sensor updates.
+type StreamFilter struct {
+	Types   []string
+	Sensors []string // Glob patterns of object IDs
+	Units   []byte
+
+	// Inclusive register range
+	HasAddress bool
+	Start, End uint16
+}
+
+// ParseStreamFilter parses the filter from the query parameters types, sensor, unit and address.
+func ParseStreamFilter(q map[string][]string) (StreamFilter, error) {
+	f := StreamFilter{}
+
+	list := func(key string) []string {
+		var l []string
+		for _, v := range q[key] {
+			for _, e := range strings.Split(v, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					l = append(l, e)
+				}
+			}
+		}
+		return l
+	}
+
+	for _, t := range list("types") {
+		switch t {
+		case StreamTypeUpdate, StreamTypeTransaction, StreamTypeEvent:
+			f.Types = append(f.Types, t)
+		default:
+			return f, fmt.Errorf("invalid type: %s", t)
+		}
+	}
+
+	for _, s := range list("sensor") {
+		if _, err := path.Match(s, ""); err != nil {
+			return f, fmt.Errorf("invalid sensor pattern: %s", s)
+		}
+
+		f.Sensors = append(f.Sensors, s)
+	}
+
+	for _, u := range list("unit") {
+		n, err := strconv.ParseUint(u, 0, 8)
+		if err != nil {
+			return f, fmt.Errorf("invalid unit: %s", u)
+		}
+
+		f.Units = append(f.Units, byte(n))
+	}
+
+	if a := q["address"]; len(a) > 0 && a[0] != "" {
+		start, end, isRange := strings.Cut(a[0], "-")
+		if !isRange {
+			end = start
+		}
+
+		s, err := strconv.ParseUint(start, 0, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid address: %s", start)
+		}
+
+		e, err := strconv.ParseUint(end, 0, 16)
+		if err != nil || e < s {
+			return f, fmt.Errorf("invalid address: %s", end)
+		}
+
+		f.HasAddress = true
+		f.Start, f.End = uint16(s), uint16(e)
+	}
+
+	return f, nil
+}
+
+func (f *StreamFilter) match(it *streamItem) bool {
+	if len(f.Types) > 0 && !contains(f.Types, it.typ) {
+		return false
+	}
+
+	if len(f.Sensors) > 0 && it.sensor != "" {
+		matched := false
+		for _, p := range f.Sensors {
+			if ok, _ := path.Match(p, it.sensor); ok {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.Units) > 0 && it.unit >= 0 && !contains(f.Units, byte(it.unit)) {
+		return false
+	}
+
+	if f.HasAddress && it.start >= 0 && (it.end < int(f.Start) || it.start > int(f.End)) {
+		return false
+	}
+
+	return true
+}
+
+func contains[T comparable](l []T, v T) bool {
+	for _, e := range l {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+type streamSubscriber struct {
+	filter   StreamFilter
+	messages chan StreamMessage
+	dropped  uint64
+}
+
+// Stream distributes sensor updates, transactions and events to the clients of the stream endpoint.
+//
+// Messages are dropped for clients which do not keep up
+// so that they can not block the decoding of captured messages.
+type Stream struct {
+	subscribers map[*streamSubscriber]struct{}
+	mutex       sync.Mutex
+}
+
+var stream = NewStream()
+
+func NewStream() *Stream {
+	return &Stream{
+		subscribers: map[*streamSubscriber]struct{}{},
+	}
+}
+
+func (s *Stream) Subscribe(f StreamFilter) *streamSubscriber {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sub := &streamSubscriber{
+		filter:   f,
+		messages: make(chan StreamMessage, streamBufferSize),
+	}
+
+	s.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+func (s *Stream) Unsubscribe(sub *streamSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.subscribers, sub)
+
+	if sub.dropped > 0 {
+		slog.Warn("Dropped stream messages of slow client", slog.Uint64("count", sub.dropped))
+	}
+}
+
+func (s *Stream) publish(it streamItem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var msg *StreamMessage
+
+	for sub := range s.subscribers {
+		if !sub.filter.match(&it) {
+			continue
+		}
+
+		// Only encode if there is an interested client
+		if msg == nil {
+			data, err := json.Marshal(it.data)
+			if err != nil {
+				slog.Error("Failed to encode stream message", slog.Any("error", err))
+				return
+			}
+
+			msg = &StreamMessage{
+				Type: it.typ,
+				Data: data,
+			}
+		}
+
+		select {
+		case sub.messages <- *msg:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Update pushes a new sensor value.
+func (s *Stream) Update(upd Update) {
+	if !isFinite(upd.Value) {
+		return
+	}
+
+	it := streamItem{
+		typ:    StreamTypeUpdate,
+		sensor: upd.Sensor.ObjectID,
+		unit:   -1,
+		start:  -1,
+	}
+
+	su := StreamUpdate{
+		Time:              upd.Time,
+		Sensor:            upd.Sensor.ObjectID,
+		Name:              upd.Sensor.Name,
+		Value:             upd.Value,
+		UnitOfMeasurement: upd.Sensor.UnitOfMeasurement,
+		Raw:               upd.Raw,
+	}
+
+	if q := upd.Sensor.Quantity; q != nil {
+		su.Register = &q.Register
+		it.start = int(q.Register)
+		it.end = int(q.Register) + q.Size - 1
+	}
+
+	it.data = &su
+
+	s.publish(it)
+}
+
+// Transaction pushes a decoded request/response pair.
+func (s *Stream) Transaction(t *Transaction) {
+	if t == nil {
+		return
+	}
+
+	s.publish(streamItem{
+		typ:   StreamTypeTransaction,
+		unit:  int(t.Unit),
+		start: int(t.Address),
+		end:   int(t.Address) + len(t.Registers) - 1,
+		data:  t,
+	})
+}
+
+// Event pushes an event. Data is given as key-value pairs.
+func (s *Stream) Event(kind, message, sensor string, data ...any) {
+	e := &StreamEvent{
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: message,
+		Sensor:  sensor,
+	}
+
+	if len(data) > 0 {
+		e.Data = map[string]any{}
+		for i := 0; i+1 < len(data); i += 2 {
+			e.Data[fmt.Sprint(data[i])] = data[i+1]
+		}
+	}
+
+	s.publish(streamItem{
+		typ:    StreamTypeEvent,
+		sensor: sensor,
+		unit:   -1,
+		start:  -1,
+		data:   e,
+	})
+}
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// httpHandleApiStream serves the stream as WebSocket if requested, and as Server-Sent Events otherwise.
+func httpHandleApiStream(w http.ResponseWriter, req *http.Request) {
+	f, err := ParseStreamFilter(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		httpServeWebSocket(w, req, f)
+	} else {
+		httpServeEvents(w, req, f)
+	}
+}
+
+func httpServeEvents(w http.ResponseWriter, req *http.Request, f StreamFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+
+	sub := stream.Subscribe(f)
+	defer stream.Unsubscribe(sub)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+		case msg := <-sub.messages:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, msg.Data); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+func httpServeWebSocket(w http.ResponseWriter, req *http.Request, f StreamFilter) {
+	conn, err := streamUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader already replied with an error
+		slog.Debug("Failed to upgrade to WebSocket", slog.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	sub := stream.Subscribe(f)
+	defer stream.Unsubscribe(sub)
+
+	// Messages of the client are discarded, but reading is required to process control frames
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+
+		case <-closed:
+			return
+
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive)); err != nil {
+				return
+			}
+
+		case msg := <-sub.messages:
+			conn.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+
+			if err := conn.WriteJSON(&msg); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Publish controls when new values of a sensor are published.
+type Publish struct {
+	// Deadband suppresses changes which are smaller than or equal to it.
+	Deadband *Deadband `json:"deadband,omitempty" yaml:"deadband,omitempty"`
+
+	// MinInterval is the minimum time between two publications.
+	MinInterval time.Duration `json:"min_interval,omitempty" yaml:"min_interval,omitempty"`
+
+	// MaxInterval is the time after which an unchanged value is republished.
+	MaxInterval time.Duration `json:"max_interval,omitempty" yaml:"max_interval,omitempty"`
+}
+
+// Deadband is either an absolute value or a percentage of the last published value.
+type Deadband struct {
+	Value   float64
+	Percent bool
+}
+
+func (d *Deadband) UnmarshalYAML(n *yaml.Node) error {
+	s := strings.TrimSpace(n.Value)
+
+	if d.Percent = strings.HasSuffix(s, "%"); d.Percent {
+		s = strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid deadband at line %d: %s", n.Line, n.Value)
+	}
+
+	d.Value = v
+
+	return nil
+}
+
+func (d *Deadband) Exceeded(last, value float64) bool {
+	band := d.Value
+	if d.Percent {
+		band = math.Abs(last) * d.Value / 100
+	}
+
+	return math.Abs(value-last) > band
+}
+
+type throttle struct {
+	*Publish
+
+	last *Update
+}
+
+// Throttler decides which updates are published.
+// It applies the per-sensor publish settings and a global budget of publications per second.
+// All decisions are based on the capture time of the updates.
+// Updates dropped due to an exhausted budget are counted in the metrics.
+type Throttler struct {
+	sensors map[*Sensor]*throttle
+
+	rate   float64 // Publications per second or zero for no limit
+	burst  float64
+	tokens float64
+	refill time.Time
+}
+
+func NewThrottler(sensors []Sensor, rate float64, burst int) *Throttler {
+	t := &Throttler{
+		sensors: map[*Sensor]*throttle{},
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+	}
+
+	if t.burst < 1 {
+		t.burst = 1
+	}
+
+	for i := range sensors {
+		s := &sensors[i]
+
+		p := s.Publish
+		if p == nil {
+			p = &Publish{}
+		}
+
+		t.sensors[s] = &throttle{
+			Publish: p,
+		}
+	}
+
+	return t
+}
+
+// Allow returns true if the update should be published.
+func (t *Throttler) Allow(upd Update) bool {
+	th, ok := t.sensors[upd.Sensor]
+	if !ok {
+		return true
+	}
+
+	if !th.due(upd) {
+		return false
+	}
+
+	if !t.take(upd.Time) {
+		metrics.PublishDropped()
+		return false
+	}
+
+	th.last = &upd
+
+	return true
+}
+
+func (th *throttle) due(upd Update) bool {
+	if th.last == nil {
+		return true
+	}
+
+	elapsed := upd.Time.Sub(th.last.Time)
+
+	if th.MinInterval > 0 && elapsed < th.MinInterval {
+		return false
+	}
+
+	if th.MaxInterval > 0 && elapsed >= th.MaxInterval {
+		return true
+	}
+
+	if th.Deadband != nil {
+		return th.Deadband.Exceeded(float64(th.last.Value), float64(upd.Value))
+	}
+
+	return true
+}
+
+// take consumes a token from the budget.
+func (t *Throttler) take(now time.Time) bool {
+	if t.rate <= 0 {
+		return true
+	}
+
+	if !t.refill.IsZero() {
+		if dt := now.Sub(t.refill).Seconds(); dt > 0 {
+			t.tokens = math.Min(t.burst, t.tokens+dt*t.rate)
+		}
+	}
+
+	if now.After(t.refill) {
+		t.refill = now
+	}
+
+	if t.tokens < 1 {
+		return false
+	}
+
+	t.tokens--
+
+	return true
+}
@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type throttleStep struct {
+	offset time.Duration // Since the first update
+	value  float32
+	allow  bool
+}
+
+func runThrottle(t *testing.T, th *Throttler, s *Sensor, steps []throttleStep) {
+	t.Helper()
+
+	ts := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	for i, st := range steps {
+		if got := th.Allow(Update{
+			Sensor: s,
+			Value:  st.value,
+			Time:   ts.Add(st.offset),
+		}); got != st.allow {
+			t.Errorf("step %d: allowed = %v, want %v", i, got, st.allow)
+		}
+	}
+}
+
+func TestDeadband(t *testing.T) {
+	tests := []struct {
+		yaml     string
+		last     float64
+		exceeded []float64
+		within   []float64
+	}{
+		{"0.5", 10, []float64{10.6, 9.4}, []float64{10, 10.5, 9.5}},
+		{"1%", 200, []float64{202.1, 197.9}, []float64{202, 198}},
+		{"1 %", -200, []float64{-202.1}, []float64{-198}},
+		{"0", 1, []float64{1.001}, []float64{1}},
+	}
+
+	for _, tt := range tests {
+		var d Deadband
+		if err := yaml.Unmarshal([]byte(tt.yaml), &d); err != nil {
+			t.Errorf("%s: failed to decode: %s", tt.yaml, err)
+			continue
+		}
+
+		for _, v := range tt.exceeded {
+			if !d.Exceeded(tt.last, v) {
+				t.Errorf("%s: change from %v to %v does not exceed deadband", tt.yaml, tt.last, v)
+			}
+		}
+
+		for _, v := range tt.within {
+			if d.Exceeded(tt.last, v) {
+				t.Errorf("%s: change from %v to %v exceeds deadband", tt.yaml, tt.last, v)
+			}
+		}
+	}
+
+	for _, s := range []string{"abc", "-1", "%"} {
+		var d Deadband
+		if err := yaml.Unmarshal([]byte(s), &d); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestThrottlerPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish *Publish
+		steps   []throttleStep
+	}{
+		{"unrestricted", nil, []throttleStep{
+			{0, 1, true},
+			{0, 1, true},
+			{time.Millisecond, 1, true},
+		}},
+		{"deadband", &Publish{
+			Deadband: &Deadband{Value: 1},
+		}, []throttleStep{
+			{0, 10, true},
+			{time.Second, 10.5, false},
+			{2 * time.Second, 11, false}, // Compared to the last published value
+			{3 * time.Second, 11.5, true},
+			{4 * time.Second, 10.5, false},
+		}},
+		{"min interval", &Publish{
+			MinInterval: 5 * time.Second,
+		}, []throttleStep{
+			{0, 1, true},
+			{time.Second, 2, false},
+			{5 * time.Second, 3, true},
+			{9 * time.Second, 4, false},
+			{10 * time.Second, 5, true},
+		}},
+		{"max interval", &Publish{
+			Deadband:    &Deadband{Value: 1},
+			MaxInterval: time.Minute,
+		}, []throttleStep{
+			{0, 1, true},
+			{30 * time.Second, 1, false},
+			{time.Minute, 1, true}, // Heartbeat
+			{90 * time.Second, 1, false},
+			{100 * time.Second, 5, true},
+		}},
+		{"min interval before deadband", &Publish{
+			Deadband:    &Deadband{Value: 1},
+			MinInterval: 10 * time.Second,
+			MaxInterval: 5 * time.Second, // Shorter than the minimum interval
+		}, []throttleStep{
+			{0, 1, true},
+			{5 * time.Second, 100, false},
+			{10 * time.Second, 1, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sensors := []Sensor{{ObjectID: "a", Publish: tt.publish}}
+
+			runThrottle(t, NewThrottler(sensors, 0, 0), &sensors[0], tt.steps)
+		})
+	}
+}
+
+func TestThrottlerBudget(t *testing.T) {
+	sensors := []Sensor{{ObjectID: "a"}}
+	th := NewThrottler(sensors, 2, 3)
+
+	dropped := metrics.Snapshot().PublishDropped
+
+	runThrottle(t, th, &sensors[0], []throttleStep{
+		{0, 1, true}, // Burst
+		{0, 2, true},
+		{0, 3, true},
+		{0, 4, false},
+		{250 * time.Millisecond, 5, false}, // Half a token
+		{500 * time.Millisecond, 6, true},
+		{500 * time.Millisecond, 7, false},
+		{10 * time.Second, 8, true}, // Refilled up to the burst
+		{10 * time.Second, 9, true},
+		{10 * time.Second, 10, true},
+		{10 * time.Second, 11, false},
+		{5 * time.Second, 12, false}, // Time going backwards does not refill the budget
+	})
+
+	if got := metrics.Snapshot().PublishDropped - dropped; got != 5 {
+		t.Errorf("got %d dropped updates, want 5", got)
+	}
+
+	// Sensors which are not configured are always published
+	runThrottle(t, th, &Sensor{}, []throttleStep{
+		{0, 1, true},
+		{0, 2, true},
+		{0, 3, true},
+		{0, 4, true},
+	})
+}
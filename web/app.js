@@ -0,0 +1,336 @@
+// SPDX-FileCopyrightText: 2023 Steffen Vogel <post@steffenvogel.de>
+// SPDX-License-Identifier: Apache-2.0
+
+'use strict';
+
+const SPARKLINE_WINDOW = 60 * 60 * 1000; // Milliseconds shown in sparklines
+const OVERVIEW_INTERVAL = 5000;
+const LOG_SIZE = 200;
+const STALE_AGE = 60 * 1000;
+
+// Sensors by object ID
+const sensors = new Map();
+
+let paused = false;
+
+function el(tag, attrs = {}, ...children) {
+	const e = document.createElement(tag);
+
+	for (const [k, v] of Object.entries(attrs)) {
+		e.setAttribute(k, v);
+	}
+
+	e.append(...children);
+
+	return e;
+}
+
+function formatValue(s) {
+	if (s.value === undefined) {
+		return '–';
+	}
+
+	if (s.component === 'binary_sensor') {
+		return s.value ? 'on' : 'off';
+	}
+
+	if (s.labels) {
+		return s.labels[String(s.value)] ?? String(s.value);
+	}
+
+	const v = s.precision !== undefined ? s.value.toFixed(s.precision) : String(Math.round(s.value * 100) / 100);
+
+	return s.unit_of_measurement ? `${v} ${s.unit_of_measurement}` : v;
+}
+
+function formatAge(t) {
+	if (!t) {
+		return 'never';
+	}
+
+	const secs = Math.max(0, Math.round((Date.now() - t) / 1000));
+
+	if (secs < 60) {
+		return `${secs}s ago`;
+	} else if (secs < 3600) {
+		return `${Math.floor(secs / 60)}m ago`;
+	} else if (secs < 86400) {
+		return `${Math.floor(secs / 3600)}h ago`;
+	}
+
+	return `${Math.floor(secs / 86400)}d ago`;
+}
+
+function sparkline(points) {
+	const ns = 'http://www.w3.org/2000/svg';
+	const svg = document.createElementNS(ns, 'svg');
+
+	svg.setAttribute('class', 'sparkline');
+	svg.setAttribute('viewBox', '0 0 120 24');
+	svg.setAttribute('preserveAspectRatio', 'none');
+
+	const now = Date.now();
+	const visible = points.filter((p) => p.t >= now - SPARKLINE_WINDOW);
+	if (visible.length < 2) {
+		return svg;
+	}
+
+	const min = Math.min(...visible.map((p) => p.v));
+	const max = Math.max(...visible.map((p) => p.v));
+	const range = max - min || 1;
+
+	const line = document.createElementNS(ns, 'polyline');
+	line.setAttribute('points', visible.map((p) => {
+		const x = 120 * (1 - (now - p.t) / SPARKLINE_WINDOW);
+		const y = 22 - 20 * (p.v - min) / range;
+		return `${x.toFixed(1)},${y.toFixed(1)}`;
+	}).join(' '));
+
+	svg.append(line);
+
+	return svg;
+}
+
+function addPoint(s, t, v) {
+	s.points.push({ t, v });
+
+	const limit = Date.now() - SPARKLINE_WINDOW;
+	while (s.points.length > 0 && s.points[0].t < limit) {
+		s.points.shift();
+	}
+}
+
+function renderSensor(s) {
+	const cells = s.row.children;
+
+	cells[2].textContent = formatValue(s);
+	cells[3].textContent = formatAge(s.time);
+	cells[3].className = s.time && Date.now() - s.time > STALE_AGE ? 'stale' : 'muted';
+	cells[4].replaceChildren(sparkline(s.points));
+
+	const rejected = Object.entries(s.rejected ?? {});
+	cells[5].textContent = rejected.length > 0 ? String(rejected.reduce((sum, [, n]) => sum + n, 0)) : '';
+	cells[5].title = rejected.map(([reason, n]) => `${reason}: ${n}`).join('\n');
+}
+
+async function loadHistory(s) {
+	const resp = await fetch(`api/v1/history/${encodeURIComponent(s.object_id)}?start=-1h&step=1m`);
+	if (!resp.ok) {
+		return;
+	}
+
+	const hist = await resp.json();
+
+	s.points = hist.records.map((r) => ({ t: Date.parse(r.time), v: r.mean })).concat(s.points);
+	renderSensor(s);
+}
+
+function initSensors(overview) {
+	const tbody = document.querySelector('#sensors tbody');
+
+	for (const o of overview.sensors) {
+		const s = {
+			...o,
+			time: o.time ? Date.parse(o.time) : undefined,
+			points: [],
+		};
+
+		s.row = el('tr', {},
+			el('td', { title: s.object_id }, s.name || s.object_id),
+			el('td', { class: 'muted' }, s.device || ''),
+			el('td', { class: 'value' }),
+			el('td'),
+			el('td'),
+			el('td', { class: 'value stale' }));
+
+		sensors.set(s.object_id, s);
+		tbody.append(s.row);
+
+		if (s.value !== undefined) {
+			addPoint(s, s.time, s.value);
+		}
+
+		renderSensor(s);
+
+		if (overview.history) {
+			loadHistory(s).catch((err) => console.error(err));
+		}
+	}
+}
+
+function renderStatus(overview) {
+	const avail = document.getElementById('available');
+	avail.textContent = overview.available ? 'available' : 'unavailable';
+	avail.className = `badge ${overview.available ? 'ok' : 'error'}`;
+
+	// Tracees
+	const tracees = document.querySelector('#tracees tbody');
+	tracees.replaceChildren();
+
+	for (const t of overview.tracees) {
+		const fds = t.fds.length > 0 ? t.fds : [{}];
+
+		fds.forEach((fd, i) => {
+			tracees.append(el('tr', {},
+				el('td', {}, i === 0 ? String(t.pid) : ''),
+				el('td', { class: t.attached ? '' : 'stale' }, i === 0 ? (t.attached ? 'attached' : 'detached') : ''),
+				el('td', {}, fd.fd !== undefined ? String(fd.fd) : '–'),
+				el('td', { class: 'value' }, String(fd.read ?? '')),
+				el('td', { class: 'value' }, String(fd.write ?? ''))));
+		});
+	}
+
+	// Bus statistics
+	const bus = overview.bus;
+	const stats = [
+		['Decoded frames', bus.frames_decoded],
+		['Filtered frames', bus.frames_filtered],
+		['Checksum errors', bus.crc_errors],
+		['Decode errors', bus.decode_errors],
+		['Message backlog', bus.backlog],
+		['MQTT publishes', bus.mqtt_publishes],
+		['MQTT failures', bus.mqtt_failures],
+		['Dropped by budget', bus.publish_dropped],
+	];
+
+	if (bus.mqtt_queue) {
+		stats.push(
+			['MQTT queue length', bus.mqtt_queue.length],
+			['MQTT messages queued', bus.mqtt_queue.queued],
+			['MQTT messages dropped', bus.mqtt_queue.dropped]);
+	}
+
+	document.querySelector('#bus dl').replaceChildren(...stats.flatMap(([k, v]) => [
+		el('dt', {}, k),
+		el('dd', {}, String(v)),
+	]));
+
+	document.querySelector('#bus tbody').replaceChildren(...bus.units.map((u) => el('tr', {},
+		el('td', {}, String(u.unit)),
+		el('td', { class: 'value' }, String(u.transactions)),
+		el('td', { class: 'value' }, `${(u.latency * 1000).toFixed(1)} ms`))));
+
+	// Values are also refreshed here in case stream messages have been dropped
+	for (const o of overview.sensors) {
+		const s = sensors.get(o.object_id);
+		if (!s) {
+			continue;
+		}
+
+		s.rejected = o.rejected;
+
+		if (!o.time) {
+			continue;
+		}
+
+		const t = Date.parse(o.time);
+		if (!s.time || t > s.time) {
+			s.value = o.value;
+			s.time = t;
+			addPoint(s, t, o.value);
+		}
+	}
+
+	for (const s of sensors.values()) {
+		renderSensor(s);
+	}
+}
+
+function log(time, type, details) {
+	if (paused) {
+		return;
+	}
+
+	const tbody = document.querySelector('#log tbody');
+
+	tbody.prepend(el('tr', {},
+		el('td', { class: 'muted' }, new Date(time).toLocaleTimeString()),
+		el('td', {}, type),
+		el('td', {}, details)));
+
+	while (tbody.children.length > LOG_SIZE) {
+		tbody.lastChild.remove();
+	}
+}
+
+function hex(n, digits) {
+	return '0x' + n.toString(16).padStart(digits, '0');
+}
+
+function connect() {
+	const conn = document.getElementById('connection');
+	const events = new EventSource('api/v1/stream');
+
+	events.onopen = () => {
+		conn.textContent = 'live';
+		conn.className = 'badge ok';
+	};
+
+	events.onerror = () => {
+		conn.textContent = 'reconnecting';
+		conn.className = 'badge error';
+	};
+
+	events.addEventListener('update', (e) => {
+		const upd = JSON.parse(e.data);
+		const s = sensors.get(upd.sensor);
+		if (!s) {
+			return;
+		}
+
+		s.value = upd.value;
+		s.time = Date.parse(upd.time);
+		addPoint(s, s.time, upd.value);
+		renderSensor(s);
+	});
+
+	events.addEventListener('transaction', (e) => {
+		const t = JSON.parse(e.data);
+		const regs = (t.registers || []).map((r) => hex(r, 4)).join(' ');
+
+		log(t.time, 'frame', `pid ${t.pid} fd ${t.fd} unit ${t.unit} fc ${t.function_code} addr ${hex(t.address, 4)} ` +
+			`latency ${(t.latency * 1000).toFixed(1)} ms: ${regs}`);
+	});
+
+	events.addEventListener('event', (e) => {
+		const ev = JSON.parse(e.data);
+		const data = ev.data ? ' ' + JSON.stringify(ev.data) : '';
+
+		log(ev.time, ev.kind, `${ev.message}${ev.sensor ? ` (${ev.sensor})` : ''}${data}`);
+	});
+}
+
+async function refresh() {
+	const resp = await fetch('api/v1/overview');
+	if (!resp.ok) {
+		throw new Error(`failed to fetch overview: ${resp.status}`);
+	}
+
+	return resp.json();
+}
+
+async function main() {
+	document.getElementById('pause').addEventListener('click', (e) => {
+		paused = !paused;
+		e.target.textContent = paused ? 'Resume' : 'Pause';
+	});
+
+	const overview = await refresh();
+
+	initSensors(overview);
+	renderStatus(overview);
+	connect();
+
+	setInterval(() => {
+		refresh().then(renderStatus).catch((err) => console.error(err));
+	}, OVERVIEW_INTERVAL);
+
+	// Update the age of values
+	setInterval(() => {
+		for (const s of sensors.values()) {
+			s.row.children[3].textContent = formatAge(s.time);
+		}
+	}, 1000);
+}
+
+main().catch((err) => console.error(err));